@@ -2,45 +2,149 @@ package main
 
 import (
 	"fmt"
-	"os"
+	"strings"
 )
 
 type AST struct {
 	Lines []Assembled
+	// The source line number each of Lines came from, and the file it's in,
+	// which is File except in .INCLUDEd files.
+	SourceLines []uint
+	SourceFiles []string
+	File        string
+
+	// Every label or symbol reference in the program, for checking that they
+	// all exist before assembling.
+	LabelUses []*LabelUse
+
+	// The contents of each .INCLUDEd file, by the path it was found at, for
+	// listings and the -cache key.
+	Included map[string][]byte
+	// Where each line indented with both tabs and spaces starts.
+	MixedIndent []Position
+	// Every string in .DAT and .BYTE values.
+	Strings []StringUse
 }
 
 // Expressions evaluate to a number.
 type Expression interface {
 	Evaluate(s *AssemblyState) uint16
-	Location() string
+	Location() Position
 }
 
 // LabelUse is a kind of expression.
 // It might be a real label, or a define.
 type LabelUse struct {
 	label string
-	loc   string
+	loc   Position
 }
 
 func (l *LabelUse) Evaluate(s *AssemblyState) uint16 {
-	value, _, known := s.lookup(l.label)
-	if !known {
-		asmError(l.loc, "Unknown label '%s'", l.label)
-		os.Exit(1)
+	if s.externals[l.label] {
+		s.referenced[l.label] = true
+		s.externalUses = append(s.externalUses, l)
+		return s.externalValue
+	}
+	value, defined, known := s.lookup(l.label)
+	s.referenced[l.label] = true
+	if lr, ok := s.labels[l.label]; ok && !lr.defined {
+		s.unplaced++ // A forward reference on the first pass.
+	} else if !ok && !defined {
+		// Undefined names are caught up front by checkUndefined, so this is a
+		// define used before its .DEFINE. Use its value from the previous pass,
+		// and let assemble check afterwards that it held. On the first pass
+		// there isn't one, so it's 0 for now like an unplaced label, and there
+		// has to be another pass to check it.
+		if s.variables[l.label] {
+			asmError(l.loc, "'%s' is used before its first .SET, so it has no value yet", l.label)
+		}
+		if !known {
+			value = 0
+			s.unplaced++
+			s.dirty = true
+		}
+		s.early[l.label] = value
 	}
 	return value
 }
 
-func (l *LabelUse) Location() string { return l.loc }
+func (l *LabelUse) Location() Position { return l.loc }
+
+// AddressOf is a label reference written =label, which must name an actual
+// label rather than a define.
+type AddressOf struct{ label *LabelUse }
+
+func (a *AddressOf) Evaluate(s *AssemblyState) uint16 {
+	if _, ok := s.labels[a.label.label]; !ok && !s.externals[a.label.label] {
+		asmError(a.label.loc, "'%s' is not a label, so =%s has no address", a.label.label, a.label.label)
+	}
+	return a.label.Evaluate(s)
+}
+
+func (a *AddressOf) Location() Position { return a.label.Location() }
+
+// LabelAttr is label.len or label.end, for a label in front of a .DAT. The
+// length is filled in by the parser.
+type LabelAttr struct {
+	label  *LabelUse
+	attr   string // "len" or "end"
+	length uint16
+}
+
+func (a *LabelAttr) Evaluate(s *AssemblyState) uint16 {
+	if a.attr == "len" {
+		s.referenced[a.label.label] = true
+		return a.length
+	}
+	return a.label.Evaluate(s) + a.length
+}
+
+func (a *LabelAttr) Location() Position { return a.label.Location() }
 
-// Constants are a fixed-value Expression.
+// Constants are a fixed-value Expression. The value is kept as written, before
+// it's cut down to 16 bits, so that wideValue can see it.
 type Constant struct {
-	value uint16
-	loc   string
+	value int64
+	loc   Position
+}
+
+func (c *Constant) Evaluate(s *AssemblyState) uint16 { return uint16(c.value) }
+func (c *Constant) Location() Position               { return c.loc }
+
+// Annotated is a # literal marked as signed or unsigned, like #s-3 or #u200.
+// The encoders check it against that, rather than reading the value however
+// the instruction would; see checkLiteral.
+type Annotated struct {
+	expr   Expression
+	signed bool
+	loc    Position
+}
+
+func (a *Annotated) Evaluate(s *AssemblyState) uint16 { return a.expr.Evaluate(s) }
+func (a *Annotated) Location() Position               { return a.loc }
+
+// describe writes the annotated value v back out, for errors.
+func (a *Annotated) describe(v int64) string {
+	if a.signed {
+		return fmt.Sprintf("#s%d", v)
+	}
+	return fmt.Sprintf("#u%d", v)
 }
 
-func (c *Constant) Evaluate(s *AssemblyState) uint16 { return c.value }
-func (c *Constant) Location() string                 { return c.loc }
+// annotatedValue evaluates a, and checks that it's what it says it is: a #u
+// can't be negative, and either kind has to fit in 16 bits read its own way.
+func annotatedValue(s *AssemblyState, a *Annotated) int64 {
+	v := wideValue(a.expr, s)
+	switch {
+	case a.signed && (v < -0x8000 || v > 0x7fff):
+		asmError(a.loc, "Literal %s doesn't fit in 16 bits signed, -32768 to 32767", a.describe(v))
+	case !a.signed && v < 0:
+		asmError(a.loc, "Literal %s is negative, but marked unsigned; use #s for a signed value", a.describe(v))
+	case !a.signed && v > 0xffff:
+		asmError(a.loc, "Literal %s doesn't fit in 16 bits unsigned, 0 to 65535", a.describe(v))
+	}
+	return v
+}
 
 type BinExpr struct {
 	lhs      Expression
@@ -48,53 +152,262 @@ type BinExpr struct {
 	rhs      Expression
 }
 
-func (b *BinExpr) Evaluate(s *AssemblyState) uint16 {
-	l := b.lhs.Evaluate(s)
-	r := b.rhs.Evaluate(s)
-	switch b.operator {
-	case PLUS:
-		return l + r
-	case MINUS:
-		return l - r
-	case TIMES:
-		return l * r
-	case DIVIDE:
-		return l / r
-	case AND:
-		return l & r
-	case OR:
-		return l | r
-	case XOR:
-		return l ^ r
-	default:
-		panic(fmt.Sprintf("unknown binary operation %s", tokenNames[b.operator]))
-	}
-}
-
-func (b *BinExpr) Location() string {
+// Evaluate works the expression out without cutting the parts down to 16 bits
+// on the way; see wideValue.
+func (b *BinExpr) Evaluate(s *AssemblyState) uint16 { return uint16(wideValue(b, s)) }
+
+func (b *BinExpr) Location() Position {
 	return b.lhs.Location()
 }
 
+// boolValue is 1 for true and 0 for false, the results of comparisons.
+func boolValue(b bool) uint16 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// PackedBytes is two bytes of a string, packed into a .DAT word in .ENDIAN
+// order.
+type PackedBytes struct {
+	first, second uint8
+	loc           Position
+}
+
+func (b *PackedBytes) Evaluate(s *AssemblyState) uint16 {
+	if s.littleEndian {
+		return uint16(b.second)<<8 | uint16(b.first)
+	}
+	return uint16(b.first)<<8 | uint16(b.second)
+}
+
+func (b *PackedBytes) Location() Position { return b.loc }
+
+// Here is $, the address currently being assembled.
+type Here struct{ loc Position }
+
+func (h *Here) Evaluate(s *AssemblyState) uint16 { return s.index }
+func (h *Here) Location() Position               { return h.loc }
+
+// pageSize is the number of words in a page, for PAGE(n): one value of the
+// high byte, as set by MVH.
+const pageSize = 256
+
+// builtins are the functions that can be called in expressions, eg.
+// PAGE(0x80). Each takes a single argument.
+var builtins = map[string]bool{
+	"PAGE": true,
+}
+
+// Call is a call to one of the builtins.
+type Call struct {
+	name string // Upcased.
+	arg  Expression
+	loc  Position
+}
+
+func (c *Call) Evaluate(s *AssemblyState) uint16 { return uint16(wideValue(c, s)) }
+
+func (c *Call) Location() Position { return c.loc }
+
 type UnaryExpr struct {
 	operator Token
 	expr     Expression
+	loc      Position // Of the operator, so errors point at the whole term.
+}
+
+func (u *UnaryExpr) Evaluate(s *AssemblyState) uint16 { return uint16(wideValue(u, s)) }
+
+func (u *UnaryExpr) Location() Position { return u.loc }
+
+// checkUndefined makes sure every name referenced in the program is a label,
+// a .DEFINE, or a register alias. It returns all the undefined names at once,
+// as an ErrorList.
+func checkUndefined(ast *AST, s *AssemblyState) error {
+	defines := make(map[string]bool)
+	aliases := make(map[string]bool)
+	strs := make(map[string]bool)
+	for _, l := range ast.Lines {
+		switch d := l.(type) {
+		case *SymbolDef:
+			defines[d.name] = true
+		case *RegAliasDef:
+			aliases[d.name] = true
+		case *StringDef:
+			strs[d.name] = true
+		}
+	}
+
+	var errs ErrorList
+	for _, u := range ast.LabelUses {
+		if _, ok := s.labels[u.label]; ok || defines[u.label] {
+			continue
+		}
+		if _, ok := s.opts.Defines[u.label]; ok || u.label == buildIDSymbol {
+			continue
+		}
+		if aliases[u.label] {
+			errs = append(errs, &Error{u.loc, fmt.Sprintf("'%s' is a register alias, not a value", u.label)})
+		} else if strs[u.label] {
+			errs = append(errs, &Error{u.loc, fmt.Sprintf("String .DEFINE '%s' is used before it's defined; move the .DEFINE earlier", u.label)})
+		} else if s.opts.Externals {
+			s.externals[u.label] = true
+		} else if attr := u.label[strings.LastIndex(u.label, ".")+1:]; attr != u.label && (strings.EqualFold(attr, "len") || strings.EqualFold(attr, "end")) {
+			// Only possible with . in -ident-chars, which takes priority.
+			errs = append(errs, &Error{u.loc, fmt.Sprintf("Undefined label '%s'; with . in -ident-chars it's all one name, so .%s doesn't apply", u.label, attr)})
+		} else {
+			errs = append(errs, &Error{u.loc, fmt.Sprintf("Undefined label '%s'", u.label)})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// checkConsts makes sure nothing redefines a .CONST, and that a .CONST
+// doesn't redefine anything either. Likewise a .SET variable is only ever
+// assigned with .SET, so that a use before the first one is caught.
+func checkConsts(ast *AST) error {
+	first := make(map[string]*SymbolDef)
+	var errs ErrorList
+	for _, l := range ast.Lines {
+		d, ok := l.(*SymbolDef)
+		if !ok {
+			continue
+		}
+		f, ok := first[d.name]
+		if !ok {
+			first[d.name] = d
+		} else if f.locked {
+			errs = append(errs, &Error{d.loc, fmt.Sprintf("'%s' is a .CONST, defined at %s, so it can't be redefined", d.name, f.loc)})
+		} else if d.locked {
+			errs = append(errs, &Error{d.loc, fmt.Sprintf(".CONST '%s' is already defined at %s; a .CONST must be the only definition", d.name, f.loc)})
+		} else if f.variable != d.variable {
+			errs = append(errs, &Error{d.loc, fmt.Sprintf("'%s' is assigned with %s at %s, so it can't be %s here too; use one or the other throughout", d.name, f.directive(), f.loc, d.directive())})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
 }
 
-func (u *UnaryExpr) Evaluate(s *AssemblyState) uint16 {
-	value := u.expr.Evaluate(s)
-	switch u.operator {
-	case PLUS:
-		return value
-	case MINUS:
-		return -value
-	case NOT:
-		return 0xffff ^ value
-	default:
-		panic(fmt.Sprintf("unknown unary operation %s", tokenNames[u.operator]))
+// wideValue evaluates expr without cutting intermediate results down to 16
+// bits, so (1 << 12) * 16 is 65536, not 0, and (1 << 12) * 16 / 32 is 2048.
+// That's how every expression is worked out; Evaluate only cuts the result
+// down at the end, and narrow checks that it fits.
+//
+// Labels and defines are always 16-bit, 0 to 0xffff, and negative numbers are
+// two's complement where it matters: >> is a logical shift of the 16 bits, >>>
+// an arithmetic one, and comparisons are between the unsigned 16-bit values,
+// as they always have been.
+func wideValue(expr Expression, s *AssemblyState) int64 {
+	switch e := expr.(type) {
+	case *Constant:
+		return e.value
+	case *Annotated:
+		return wideValue(e.expr, s)
+	case *BinExpr:
+		l := wideValue(e.lhs, s)
+		before := s.unplaced
+		r := wideValue(e.rhs, s)
+		switch e.operator {
+		case PLUS:
+			return l + r
+		case MINUS:
+			return l - r
+		case TIMES:
+			return l * r
+		case DIVIDE:
+			if r == 0 {
+				// A label that hasn't been placed yet is 0 for now; the next
+				// pass will say whether it really is.
+				if s.unplaced != before {
+					return 0
+				}
+				asmError(e.Location(), "Division by zero")
+			}
+			return l / r
+		case AND:
+			return l & r
+		case OR:
+			return l | r
+		case XOR:
+			return l ^ r
+		case LANGLES:
+			if r < 0 || r > 63 {
+				return 0
+			}
+			return l << r
+		case RANGLES:
+			if r < 0 || r > 63 {
+				return 0
+			}
+			if l < 0 {
+				l = int64(uint16(l))
+			}
+			return l >> r
+		case ASR:
+			if r < 0 || r > 15 {
+				r = 15 // Just the sign bit, everywhere.
+			}
+			return int64(uint16(int16(uint16(l)) >> r))
+		case EQ:
+			return int64(boolValue(uint16(l) == uint16(r)))
+		case NE:
+			return int64(boolValue(uint16(l) != uint16(r)))
+		case LT:
+			return int64(boolValue(uint16(l) < uint16(r)))
+		case LE:
+			return int64(boolValue(uint16(l) <= uint16(r)))
+		case GT:
+			return int64(boolValue(uint16(l) > uint16(r)))
+		case GE:
+			return int64(boolValue(uint16(l) >= uint16(r)))
+		default:
+			panic(fmt.Sprintf("unknown binary operation %s", tokenNames[e.operator]))
+		}
+	case *UnaryExpr:
+		v := wideValue(e.expr, s)
+		switch e.operator {
+		case PLUS:
+			return v
+		case MINUS:
+			return -v
+		case NOT:
+			return ^v
+		default:
+			panic(fmt.Sprintf("unknown unary operation %s", tokenNames[e.operator]))
+		}
+	case *Call:
+		v := wideValue(e.arg, s)
+		switch e.name {
+		case "PAGE":
+			if v < 0 || v >= 0x10000/pageSize {
+				asmError(e.arg.Location(), "PAGE(%d) is past the end of memory; pages go up to %d", v, 0x10000/pageSize-1)
+			}
+			return v * pageSize
+		default:
+			panic(fmt.Sprintf("unknown builtin %s", e.name))
+		}
 	}
+	return int64(expr.Evaluate(s))
 }
 
-func (u *UnaryExpr) Location() string { return u.expr.Location() }
+// narrow evaluates expr where it's used, and has to come down to 16 bits.
+// Anything from -0xffff to 0xffff does, with negative values in two's
+// complement; outside that, the value has lost its top bits, and it's an
+// error rather than quietly becoming something else. .DAT values are the
+// exception, which -Wtruncate covers.
+func narrow(s *AssemblyState, expr Expression) uint16 {
+	v := wideValue(expr, s)
+	if v > 0xffff || v < -0xffff {
+		asmError(expr.Location(), "Value %d (%#x) doesn't fit in 16 bits", v, v)
+	}
+	return uint16(v)
+}
 
 // Assembled describes something that can be assembled into the binary,
 // such as an instruction, and some directives.
@@ -102,49 +415,255 @@ type Assembled interface {
 	Assemble(s *AssemblyState)
 }
 
+// Include marks an .INCLUDE. The parser reads the file in its place, so the
+// included lines follow this one, and there's nothing to do here.
 type Include struct{ filename string }
 
-func (i *Include) Assemble(s *AssemblyState) {
-	panic("can't happen! Include survived to assembly time")
-}
+func (i *Include) Assemble(s *AssemblyState) {}
 
 type Org struct{ loc Expression }
 
 func (o *Org) Assemble(s *AssemblyState) {
-	s.index = o.loc.Evaluate(s)
+	s.index = narrow(s, o.loc)
+	s.wrapped = false
+	s.jumps = append(s.jumps, jump{s.index, o.loc.Location()})
+}
+
+// Reserve is .RESERVE, which skips over some words without writing them. They
+// don't count as used, so the output only includes them when something after
+// them does.
+type Reserve struct{ length Expression }
+
+func (r *Reserve) Assemble(s *AssemblyState) {
+	n := narrow(s, r.length)
+	if int(s.index)+int(n) > 0x10000 {
+		asmError(r.length.Location(), ".RESERVE of %d words runs past the end of memory", n)
+	}
+	s.index += n
+	s.wrapped = s.wrapped || (n > 0 && s.index == 0)
+	s.jumps = append(s.jumps, jump{s.index, r.length.Location()})
+}
+
+// Align is .ALIGN n, which pads with the current .PADVALUE until the index is
+// a multiple of n.
+type Align struct{ boundary Expression }
+
+func (a *Align) Assemble(s *AssemblyState) {
+	n := narrow(s, a.boundary)
+	if n == 0 {
+		asmError(a.boundary.Location(), ".ALIGN 0 makes no sense; use .ALIGN 1 for no alignment")
+	}
+	gap := (n - s.index%n) % n
+	if int(s.index)+int(gap) > 0x10000 {
+		asmError(a.boundary.Location(), ".ALIGN %d runs past the end of memory", n)
+	}
+	for i := uint16(0); i < gap; i++ {
+		s.push(s.padValue)
+	}
+}
+
+// PadValue is .PADVALUE, which sets the filler for any .ALIGNs after it.
+type PadValue struct{ value Expression }
+
+func (p *PadValue) Assemble(s *AssemblyState) {
+	s.padValue = narrow(s, p.value)
 }
 
 type SymbolDef struct {
-	name  string
-	value Expression
+	name     string
+	value    Expression
+	loc      Position
+	locked   bool // A .CONST, which can't be redefined.
+	variable bool // A .SET, which is meant to be reassigned.
+}
+
+// directive names the directive d came from, for messages.
+func (d *SymbolDef) directive() string {
+	switch {
+	case d.locked:
+		return ".CONST"
+	case d.variable:
+		return ".SET"
+	}
+	return ".DEFINE"
 }
 
 func (d *SymbolDef) Assemble(s *AssemblyState) {
-	s.updateSymbol(d.name, d.value.Evaluate(s))
+	// It still works in expressions, but reads like an instruction.
+	if name := strings.ToUpper(d.name); knownMnemonic(name) || parsedMnemonics[name] {
+		s.warn(d.loc, "%s name '%s' is also an instruction mnemonic", d.directive(), d.name)
+	}
+	value := narrow(s, d.value)
+	// Only a second .DEFINE on the same pass counts; every pass sees the first.
+	// Changing a .SET is the point of it.
+	if prev, ok := s.definedAt[d.name]; ok && s.opts.WarnRedefine && !d.variable && s.symbols[d.name].value != value {
+		s.warn(d.loc, "'%s' was defined as %d at %s, and this redefines it as %d", d.name, s.symbols[d.name].value, prev, value)
+	}
+	s.definedAt[d.name] = d.loc
+	s.updateSymbol(d.name, value)
+}
+
+// RegAliasDef records a .DEFINEREG. Aliases are resolved by the parser, so
+// there's nothing to assemble.
+type RegAliasDef struct {
+	name string
+	reg  uint16
+}
+
+func (d *RegAliasDef) Assemble(s *AssemblyState) {}
+
+// StringDef records a .DEFINE with a string value. Uses are expanded by the
+// parser, so there's nothing to assemble.
+type StringDef struct {
+	name string
+	text string
+}
+
+func (d *StringDef) Assemble(s *AssemblyState) {}
+
+// StringEncoding records a .STRINGS. String literals are expanded by the
+// parser, so there's nothing to assemble.
+type StringEncoding struct{ mode string }
+
+func (e *StringEncoding) Assemble(s *AssemblyState) {}
+
+// Message is a user-supplied .ERROR or .WARNING. Errors abort the assembly;
+// warnings are reported (once) and assembly continues.
+type Message struct {
+	fatal bool
+	msg   string
+	loc   Position
+}
+
+func (m *Message) Assemble(s *AssemblyState) {
+	if m.fatal {
+		asmError(m.loc, "%s", m.msg)
+	} else {
+		s.warn(m.loc, "%s", m.msg)
+	}
+}
+
+// Assert is .ASSERT, which fails the assembly if its condition is 0. Early
+// passes can see labels that haven't settled yet, so failures are only
+// reported from the final pass.
+type Assert struct {
+	cond Expression
+	msg  string
+	loc  Position
+}
+
+func (a *Assert) Assemble(s *AssemblyState) {
+	if wideValue(a.cond, s) != 0 {
+		return
+	}
+	msg := "Assertion failed"
+	if a.msg != "" {
+		msg += ": " + a.msg
+	}
+	s.failedAsserts = append(s.failedAsserts, &Error{a.loc, msg})
 }
 
 type DatBlock struct{ values []Expression }
 
 func (b *DatBlock) Assemble(s *AssemblyState) {
 	for _, v := range b.values {
+		if s.opts.WarnTruncate {
+			// Negative values are fine, down to the smallest signed 16-bit value.
+			if w := wideValue(v, s); w > 0xffff || w < -0x8000 {
+				s.warn(v.Location(), ".DAT value %d (%#x) doesn't fit in 16 bits, and is truncated to 0x%04x", w, w, uint16(w))
+			}
+		}
+		if name, addend, ok := externalRef(s, v); ok {
+			s.relocate(name, relocWord, addend)
+			s.push(addend)
+			continue
+		}
 		s.push(v.Evaluate(s))
 	}
 }
 
-type FillBlock struct {
-	length Expression
+// RawWord is a single word from .WORD or .OPCODE. The latter marks the word as
+// a hand-encoded instruction rather than data.
+type RawWord struct {
 	value  Expression
+	opcode bool
+}
+
+func (w *RawWord) Assemble(s *AssemblyState) {
+	if name, addend, ok := externalRef(s, w.value); ok {
+		s.relocate(name, relocWord, addend)
+		s.push(addend)
+		return
+	}
+	s.push(narrow(s, w.value))
+}
+
+// ByteBlock is a list of bytes, packed two to a word according to the current
+// .ENDIAN setting. An odd byte out is padded with 0.
+type ByteBlock struct{ values []Expression }
+
+func (b *ByteBlock) Assemble(s *AssemblyState) {
+	bytes := make([]byte, len(b.values))
+	for i, v := range b.values {
+		bytes[i] = byte(checkLiteral(s, v, false, 8))
+	}
+	s.pushBytes(bytes, s.littleEndian)
+}
+
+// Endian is the .ENDIAN directive. It only changes how bytes are packed into
+// words for data like .BYTE; instructions and the output file are unaffected.
+type Endian struct{ little bool }
+
+func (e *Endian) Assemble(s *AssemblyState) {
+	s.littleEndian = e.little
+}
+
+// Byte orders for IncBin. The zero value follows .ENDIAN.
+const (
+	bigEndian = iota + 1
+	littleEndian
+)
+
+// IncBin is a binary file included with .INCBIN, packed two bytes to a word.
+type IncBin struct {
+	data  []byte
+	order int // 0 for the current .ENDIAN, or bigEndian/littleEndian.
+}
+
+func (b *IncBin) Assemble(s *AssemblyState) {
+	little := s.littleEndian
+	if b.order != 0 {
+		little = b.order == littleEndian
+	}
+	s.pushBytes(b.data, little)
+}
+
+type FillBlock struct {
+	length  Expression
+	value   Expression
+	keyword bool // Written with count= and value=, so they can't be the wrong way around.
 }
 
 func (b *FillBlock) Assemble(s *AssemblyState) {
-	len := b.length.Evaluate(s)
-	val := b.value.Evaluate(s)
-	for i := uint16(0); i < len; i++ {
+	count := narrow(s, b.length)
+	val := narrow(s, b.value)
+	if int(s.index)+int(count) > 0x10000 {
+		if b.keyword {
+			asmError(b.length.Location(), ".FILL of %d words runs past the end of memory", count)
+		}
+		asmError(b.length.Location(), ".FILL of %d words runs past the end of memory. (The order is .FILL value, count; are they swapped?)", count)
+	}
+	for i := uint16(0); i < count; i++ {
 		s.push(val)
 	}
 }
 
-type LabelDef struct{ label string }
+// LabelDef defines a label at the current address. Several labels can share
+// an address, eg. :start :entry on one line.
+type LabelDef struct {
+	label string
+	loc   Position
+}
 
 func (l *LabelDef) Assemble(s *AssemblyState) {
 	// Labels are collected in an earlier pass, but we need to note the current
@@ -155,34 +674,193 @@ func (l *LabelDef) Assemble(s *AssemblyState) {
 type Instruction struct {
 	opcode string // Should be upcased.
 	args   []*Arg
-	loc    string
+	loc    Position
 }
 
 func (op *Instruction) Assemble(s *AssemblyState) {
+	start := s.index
+	var encoder string
+	op.checkRegisters()
+
 	// We check for this opcode in each of the format types, and if it
 	// matches the right arguments then we assemble it thus.
 	if n, ok := rrrInstructions[op.opcode]; ok && len(op.args) == 3 &&
 		op.args[0].kind == AT_REG && op.args[1].kind == AT_REG && op.args[2].kind == AT_REG {
+		encoder = "rrr"
 		opRRR(op.loc, op.opcode, n, op.args, s)
 	} else if n, ok := rrInstructions[op.opcode]; ok && len(op.args) == 2 &&
 		op.args[0].kind == AT_REG && op.args[1].kind == AT_REG {
+		encoder = "rr"
 		opRR(op.loc, op.opcode, n, op.args, s)
 	} else if n, ok := rInstructions[op.opcode]; ok && len(op.args) == 1 && op.args[0].kind == AT_REG {
+		encoder = "r"
 		opR(op.loc, op.opcode, n, op.args, s)
 	} else if n, ok := voidInstructions[op.opcode]; ok && len(op.args) == 0 {
+		encoder = "void"
 		opVoid(op.loc, op.opcode, n, s)
 	} else if n, ok := riInstructions[op.opcode]; ok && len(op.args) == 2 &&
 		op.args[0].kind == AT_REG && op.args[1].kind == AT_LITERAL {
+		encoder = "ri"
 		opRI(op.loc, op.opcode, n, op.args, s)
-	} else if n, ok := branchInstructions[op.opcode]; ok && len(op.args) == 1 && op.args[0].kind == AT_LABEL {
+	} else if n, ok := branchInstructions[op.opcode]; ok && len(op.args) == 1 &&
+		(op.args[0].kind == AT_LABEL || op.args[0].kind == AT_LITERAL) {
+		// B #label is unambiguous, so it's accepted too.
+		encoder = "branch"
 		opBranch(op.loc, op.opcode, n, op.args, s)
 	} else if f, ok := specialInstructions[op.opcode]; ok {
+		encoder = "special"
 		f(op.loc, op.opcode, op.args, s)
-	} else {
+	} else if base, cond, ok := splitCondition(op.opcode); ok {
+		asmError(op.loc, "%s", conditionSuffixError(base, cond))
+	} else if !knownMnemonic(op.opcode) {
 		asmError(op.loc, "Unrecognized opcode: %s", op.opcode)
+	} else if _, ok := voidInstructions[op.opcode]; ok {
+		// RFI, RET, BRK etc. have no spare bits for an operand.
+		asmError(op.loc, "%s takes no operands, but found %s", op.opcode, showArgs(op.args))
+	} else if _, ok := riInstructions[op.opcode]; !ok && hasLiteral(op.args) {
+		// Eg. TST and CMN only come in register-register forms.
+		asmError(op.loc, "%s has no immediate form", op.opcode)
+	} else {
+		asmError(op.loc, "Unrecognized arguments to %s: %s", op.opcode, showArgs(op.args))
+	}
+
+	if s.opts.TraceEncoding {
+		words := make([]string, 0, 2)
+		for a := start; a != s.index; a++ {
+			words = append(words, fmt.Sprintf("%04x", s.rom[a]))
+		}
+		s.traces = append(s.traces, fmt.Sprintf("%s %s %s -> %s encoder: %s",
+			op.loc, op.opcode, showArgs(op.args), encoder, strings.Join(words, " ")))
+	}
+	if s.opts.RecordEncodings {
+		recordEncoding(s, op, encoder, start)
 	}
 }
 
+// checkRegisters catches labels and literals where a register belongs, eg.
+// MOV foo, r1 or ADD r0, count. Those are easy mistakes to make, and the
+// encoders would only say the arguments were unrecognized. Branches are the
+// only instructions that take a bare label.
+func (op *Instruction) checkRegisters() {
+	if !knownMnemonic(op.opcode) {
+		return
+	}
+	// LR isn't one of the general registers. BL and BLX set it, RET reads it,
+	// and PUSH saves it, and that's all.
+	for _, a := range op.args {
+		if a.kind != AT_LR {
+			continue
+		}
+		fix := "to get its value, PUSH {LR} and then POP it into a register"
+		if op.opcode == "BX" || op.opcode == "B" {
+			fix = "to return to it, use RET"
+		}
+		asmError(op.loc, "LR can only be used in a PUSH register list, not as an operand of %s; %s", op.opcode, fix)
+	}
+	if _, ok := branchInstructions[op.opcode]; ok {
+		return
+	}
+	if _, ok := voidInstructions[op.opcode]; ok {
+		return // Any operand at all is an error, reported below.
+	}
+	for i, a := range op.args {
+		switch {
+		case a.kind == AT_LABEL && i == 0 && op.opcode != "SWI":
+			asmError(a.label.Location(), "%s needs a register as its first operand, but found %s",
+				op.opcode, describeOperand(a.label))
+		case a.kind == AT_LABEL:
+			asmError(a.label.Location(), "%s needs a register or #literal as operand %d, but found %s; literals need a #%s",
+				op.opcode, i+1, describeOperand(a.label), suggestHash(a.label))
+		case a.kind == AT_LITERAL && i == 0 && op.opcode != "SWI":
+			asmError(a.lit.Location(), "%s needs a register as its first operand, but found a literal", op.opcode)
+		}
+	}
+}
+
+// describeOperand names an expression for an error message: a label by its
+// name, a number by its value, anything else generically.
+func describeOperand(e Expression) string {
+	switch e := e.(type) {
+	case *LabelUse:
+		return fmt.Sprintf("the label '%s'", e.label)
+	case *Constant:
+		return fmt.Sprintf("the number %d", e.value)
+	}
+	return "an expression"
+}
+
+// suggestHash spells out the fix for a missing #, where the expression is
+// simple enough to write back out.
+func suggestHash(e Expression) string {
+	switch e := e.(type) {
+	case *LabelUse:
+		return fmt.Sprintf(", eg. #%s", e.label)
+	case *Constant:
+		return fmt.Sprintf(", eg. #%d", e.value)
+	}
+	return ""
+}
+
+// knownMnemonic returns true if the opcode appears in any of the instruction
+// tables.
+func knownMnemonic(opcode string) bool {
+	for _, table := range []map[string]uint16{riInstructions, rrrInstructions,
+		rrInstructions, rInstructions, voidInstructions, branchInstructions} {
+		if _, ok := table[opcode]; ok {
+			return true
+		}
+	}
+	_, ok := specialInstructions[opcode]
+	return ok
+}
+
+// splitCondition splits eg. MOVEQ into MOV and EQ, if the opcode is a known
+// mnemonic followed by one of the branch condition codes.
+func splitCondition(opcode string) (string, string, bool) {
+	if len(opcode) < 3 {
+		return "", "", false
+	}
+	base, cond := opcode[:len(opcode)-2], opcode[len(opcode)-2:]
+	if _, ok := invertedConditions[cond]; !ok {
+		return "", "", false
+	}
+	return base, cond, knownMnemonic(base) || parsedMnemonics[base]
+}
+
+// conditionSuffixError explains that there's no ARM-style MOVEQ and friends.
+// Only branches have condition codes.
+func conditionSuffixError(base, cond string) string {
+	return fmt.Sprintf("Condition suffixes are only valid on branch instructions, so there's no %s%s; branch around a plain %s instead, eg. with B%s",
+		base, cond, base, invertedConditions[cond])
+}
+
+// invertedConditions maps each branch condition to its opposite, for skipping
+// over an instruction that should only run when the condition holds.
+var invertedConditions = map[string]string{
+	"EQ": "NE", "NE": "EQ",
+	"CS": "CC", "CC": "CS",
+	"MI": "PL", "PL": "MI",
+	"VS": "VC", "VC": "VS",
+	"HI": "LS", "LS": "HI",
+	"GE": "LT", "LT": "GE",
+	"GT": "LE", "LE": "GT",
+}
+
+// parsedMnemonics are the instructions with their own syntax, which the parser
+// turns into LoadStore and StackOp rather than an Instruction.
+var parsedMnemonics = map[string]bool{
+	"LDR": true, "STR": true, "PUSH": true, "POP": true, "LDMIA": true, "STMIA": true,
+}
+
+func hasLiteral(args []*Arg) bool {
+	for _, a := range args {
+		if a.kind == AT_LITERAL {
+			return true
+		}
+	}
+	return false
+}
+
 type LoadStore struct {
 	storing bool
 	dest    uint16 // Destination register. Required
@@ -196,10 +874,10 @@ func (op *LoadStore) Assemble(s *AssemblyState) {
 	// Deal with the SP special case first.
 	opcode := uint16(0)
 	if op.base == 0xffff {
-		// Always an 8-bit unsigned offset.
+		// Always an unsigned offset, which gets the 7 bits below Rd.
 		off := uint16(0)
 		if op.preLit != nil {
-			off = checkLiteral(s, op.preLit, false, 4)
+			off = checkOffset(s, op.preLit, 7)
 		}
 
 		opcode = 6
@@ -221,7 +899,7 @@ func (op *LoadStore) Assemble(s *AssemblyState) {
 		if op.storing {
 			opcode++
 		}
-		value := checkLiteral(s, op.preLit, false, 4)
+		value := checkOffset(s, op.preLit, 4)
 		s.push(0xc000 | (opcode << 10) | (op.dest << 7) | (op.base << 4) | value)
 	} else { // Postlit, maybe 0.
 		opcode = 0
@@ -230,20 +908,26 @@ func (op *LoadStore) Assemble(s *AssemblyState) {
 		}
 		var value uint16
 		if op.postLit != nil {
-			value = checkLiteral(s, op.postLit, false, 4)
+			value = checkOffset(s, op.postLit, 4)
 		}
 		s.push(0xc000 | (opcode << 10) | (op.dest << 7) | (op.base << 4) | value)
 	}
 }
 
-func asmError(loc, msg string, args ...interface{}) {
-	fmt.Printf("Assembly error at "+loc+" "+msg+"\n", args...)
-	os.Exit(1)
+// asmError aborts the assembly with an error at loc. It panics with an
+// *Error, which assemble recovers and returns.
+func asmError(loc Position, msg string, args ...interface{}) {
+	panic(&Error{loc, fmt.Sprintf(msg, args...)})
 }
 
-// Exits with an error message if the literal won't fit.
+// Exits with an error message if the literal won't fit. A literal annotated
+// with #s or #u is range checked as what it says it is, so #s-3 is an error for
+// an unsigned field rather than being read as 65533.
 func checkLiteral(s *AssemblyState, expr Expression, signed bool, width uint) uint16 {
-	value := expr.Evaluate(s)
+	if a, ok := expr.(*Annotated); ok {
+		return checkAnnotated(s, a, signed, width)
+	}
+	value := narrow(s, expr)
 	loc := expr.Location()
 	if !signed {
 		if value < (1 << width) {
@@ -261,6 +945,44 @@ func checkLiteral(s *AssemblyState, expr Expression, signed bool, width uint) ui
 	return 0 // Never actually happens.
 }
 
+// checkAnnotated is checkLiteral for an annotated literal.
+func checkAnnotated(s *AssemblyState, a *Annotated, signed bool, width uint) uint16 {
+	v := annotatedValue(s, a)
+	lo, hi, kind := int64(0), int64(1)<<width-1, "unsigned"
+	if signed {
+		lo, hi, kind = -(int64(1) << (width - 1)), int64(1)<<(width-1)-1, "signed"
+	}
+	if v < lo || v > hi {
+		asmError(a.loc, "Literal %s is out of range for this %d-bit %s field, %d to %d", a.describe(v), width, kind, lo, hi)
+	}
+	return uint16(v) & (1<<width - 1)
+}
+
+// Load/store offsets are always unsigned; none of the addressing modes accept a
+// negative offset. This gives a clearer error than checkLiteral when the value
+// is (presumably) a negative number.
+//
+// An offset using a label that hasn't been placed yet, like #end - base, isn't
+// checked until the next pass; the instruction is one word either way.
+func checkOffset(s *AssemblyState, expr Expression, width uint) uint16 {
+	before := s.unplaced
+	value := narrow(s, expr)
+	if s.unplaced != before {
+		return 0
+	}
+	a, annotated := expr.(*Annotated)
+	if annotated {
+		annotatedValue(s, a)
+	}
+	if value&0x8000 != 0 && !(annotated && !a.signed) {
+		asmError(expr.Location(), "Load/store offsets are unsigned; negative offset %d is not supported", int16(value))
+	}
+	if max := uint16(1)<<width - 1; value > max {
+		asmError(expr.Location(), "Load/store offset %d (0x%x) is out of range; the limit is %d (%d bits)", value, value, max, width)
+	}
+	return value
+}
+
 type StackOp struct {
 	regs    uint16
 	storing bool
@@ -299,6 +1021,7 @@ const (
 	AT_RLIST // Uses reg and lrpc
 	AT_LABEL
 	AT_LITERAL
+	AT_LR // Never valid, but parsed so the error can say why.
 )
 
 type Arg struct {
@@ -392,7 +1115,7 @@ var branchInstructions = map[string]uint16{
 	"BLE": 0xf,
 }
 
-var specialInstructions = map[string]func(string, string, []*Arg, *AssemblyState){
+var specialInstructions = map[string]func(Position, string, []*Arg, *AssemblyState){
 	"ADD": opAddSub,
 	"SUB": opAddSub,
 	"SWI": opSWI,
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestFillPastEnd(t *testing.T) {
+	const hint = "are they swapped?"
+	tests := []struct {
+		src  string
+		hint bool
+	}{
+		{".org 0xfffe\n  .fill 0, 4\n", true},
+		{".org 0xfffe\n  .fill count=4, value=0\n", false},
+		{".org 0xfffe\n  .fill value=0, count=4\n", false},
+	}
+	for _, tc := range tests {
+		_, err := assembleWords(t, tc.src)
+		if err == nil || !strings.Contains(err.Error(), ".FILL of 4 words runs past the end of memory") {
+			t.Errorf("%q: got error %v, want it to run past the end", tc.src, err)
+		} else if got := strings.Contains(err.Error(), hint); got != tc.hint {
+			t.Errorf("%q: got error %v; want the hint %t", tc.src, err, tc.hint)
+		}
+	}
+}
+
+// exprTest is an expression, and its 16-bit value in a .DAT. It can use after,
+// a label at 1, and five, a .DEFINE of 5; both come after the .DAT.
+type exprTest struct {
+	expr string
+	want uint16
+}
+
+func checkExprs(t *testing.T, tests []exprTest) {
+	t.Helper()
+	for _, tc := range tests {
+		words, err := assembleWords(t, ".dat "+tc.expr+"\n:after\n.define five, 5\n")
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tc.expr, err)
+		} else if len(words) != 1 || words[0] != tc.want {
+			t.Errorf("%s: got %04x, want %04x", tc.expr, words, tc.want)
+		}
+	}
+}
+
+func TestShiftRight(t *testing.T) {
+	// >> shifts in zeroes, and >>> copies the sign bit of the 16-bit value.
+	checkExprs(t, []exprTest{
+		{"0x8000 >> 1", 0x4000},
+		{"0x8000 >>> 1", 0xc000},
+		{"0xffff >> 15", 0x0001},
+		{"0xffff >>> 15", 0xffff},
+		{"-16 >> 2", 0x3ffc},
+		{"-16 >>> 2", 0xfffc},
+		{"0x7fff >> 14", 0x0001},
+		{"0x7fff >>> 14", 0x0001},
+		{"0x8000 >>> 0", 0x8000},
+	})
+}
+
+func TestUnary(t *testing.T) {
+	checkExprs(t, []exprTest{
+		{"-5", 0xfffb},
+		{"- -5", 0x0005},
+		{"-(2 + 3)", 0xfffb},
+		{"~(1 << 3)", 0xfff7},
+		{"~0", 0xffff},
+		{"~0xffff", 0x0000},
+		{"-~0", 0x0001},
+		{"~-1", 0x0000},
+		{"-0x8000", 0x8000},
+		{"- -0x8000", 0x8000},
+		{"-after", 0xffff},
+		{"~after", 0xfffe},
+		{"+five", 0x0005},
+		{"-(after + five)", 0xfffa},
+		// Unary operators bind tighter than any binary one.
+		{"-five * 2", 0xfff6},
+		{"-five + 10", 0x0005},
+		{"2 - -3", 0x0005},
+		{"2 * -after", 0xfffe},
+		{"~1 & 0xff", 0x00fe},
+	})
+}
+
+func TestWideIntermediates(t *testing.T) {
+	// The parts of an expression aren't cut down to 16 bits, only the result.
+	checkExprs(t, []exprTest{
+		{"(1 << 12) * 16 / 32", 0x0800},
+		{"0x12345 >> 4", 0x1234},
+		{"0x10000 - 1", 0xffff},
+		{"(0xffff * 0xffff) >> 16", 0xfffe},
+		{"(1 << 40) >> 36", 0x0010},
+		{"(65536 + 5) & 0xff", 0x0005},
+		{"-6 / 2", 0xfffd},
+		{"(five << 16) / (after << 16)", 0x0005},
+	})
+	checkWords(t, []wordTest{
+		{src: "ldr r0, [r1, #(1 << 16) >> 14]", want: 0xc814},
+		{src: "mov r0, #(1 << 12) * 16", err: "Value 65536 (0x10000) doesn't fit in 16 bits"},
+		{src: "mov r0, #-65536", err: "Value -65536 (-0x10000) doesn't fit in 16 bits"},
+		{src: "add r0, #(1 << 20) >> 12", err: "256 (0x100) is too big for 8-bit literal"},
+	})
+
+	// A divisor from further down is 0 until it's placed, which isn't a
+	// division by zero unless it stays that way.
+	checkExprs(t, []exprTest{{"10 / after", 10}, {"10 / five", 2}})
+	for _, src := range []string{".dat 1 / 0\n", ".dat 1 / (b - a)\n:a\n:b\n", ".dat 1 / x\n.define x, 0\n"} {
+		if _, err := assembleWords(t, src); err == nil || !strings.Contains(err.Error(), "Division by zero") {
+			t.Errorf("%q: got error %v, want division by zero", src, err)
+		}
+	}
+
+	// .DAT cuts its values down, and -Wtruncate says so.
+	_, warnings, err := AssembleBytes("test.asm", strings.NewReader(".dat 65536\n"), Options{WarnTruncate: true}, binary.BigEndian)
+	if err != nil || len(warnings) != 1 {
+		t.Errorf(".dat 65536 with -Wtruncate: got warnings %v, error %v", warnings, err)
+	}
+}
+
+func TestEarlyDefine(t *testing.T) {
+	// A define used before its .DEFINE is 0 on the first pass, which mustn't
+	// fail a range check its real value passes, nor skip one it fails.
+	for _, tc := range []struct {
+		src  string
+		want uint16
+		err  string
+	}{
+		{src: "  ldr r0, [r1, #x - 1]\n.define x, 3\n", want: 0xc812},
+		{src: "  ldr r0, [sp, #frame - 1]\n.define frame, 100\n", want: 0xd863},
+		{src: "  ldr r0, [r1, #x - 1]\n.define x, 0\n", err: "negative offset -1 is not supported"},
+	} {
+		words, err := assembleWords(t, tc.src)
+		switch {
+		case tc.err != "":
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%q: got error %v, want %q", tc.src, err, tc.err)
+			}
+		case err != nil:
+			t.Errorf("%q: unexpected error %v", tc.src, err)
+		case len(words) != 1 || words[0] != tc.want:
+			t.Errorf("%q: got %04x, want %04x", tc.src, words, tc.want)
+		}
+	}
+}
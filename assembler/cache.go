@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The -cache file holds the label and define values from the last successful
+// assembly, to seed the next one. With every label already where it ends up,
+// the passes settle after the first.
+//
+// The file starts with a key covering everything that decides the layout:
+// the source, any .INCLUDE and .INCBIN data, the -defines, the options and how
+// the source was scanned (-ident-chars makes msg.len one name). Labels can
+// settle in more than one valid arrangement (a long branch might make its
+// target far enough away to need the long form), so seeding with values from a
+// different build could give a different binary. Any change to those inputs
+// makes the cache stale, and it's ignored.
+
+const cacheHeader = "risque16-symbols 1"
+
+// cacheKey hashes the inputs that decide the program's layout. sc is the
+// scanner the source was parsed with, for its settings.
+func cacheKey(source []byte, ast *AST, opts Options, sc *Scanner) string {
+	h := sha256.New()
+	h.Write(source)
+	for _, path := range sortedKeys(ast.Included) {
+		fmt.Fprintf(h, "\x00%s\x00", path)
+		h.Write(ast.Included[path])
+	}
+	for _, l := range ast.Lines {
+		if b, ok := l.(*IncBin); ok {
+			h.Write(b.data)
+		}
+	}
+
+	names := make([]string, 0, len(opts.Defines))
+	for name := range opts.Defines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(h, "\x00%s=%d", name, opts.Defines[name])
+	}
+	fmt.Fprintf(h, "\x00org=%d collapse=%t build=%d externals=%t", opts.Origin, !opts.NoOpCollapse, opts.BuildID, opts.Externals)
+	fmt.Fprintf(h, "\x00alt-comments=%t ident-chars=%q", sc.altComments, sc.identChars)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// symbolCache is the contents of a -cache file: the final values of the labels
+// and defines.
+type symbolCache struct {
+	labels  map[string]uint16
+	defines map[string]uint16
+}
+
+// readCache returns the values saved in the cache file, or nil if there's no
+// cache, it's unreadable, or it was made for a different key.
+func readCache(name, key string) *symbolCache {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	if !sc.Scan() || sc.Text() != cacheHeader || !sc.Scan() || sc.Text() != "key "+key {
+		return nil
+	}
+	c := &symbolCache{make(map[string]uint16), make(map[string]uint16)}
+	for sc.Scan() {
+		fields := strings.Fields(sc.Text())
+		if len(fields) != 3 {
+			return nil
+		}
+		v, err := strconv.ParseUint(fields[2], 16, 16)
+		if err != nil {
+			return nil
+		}
+		switch fields[0] {
+		case "label":
+			c.labels[fields[1]] = uint16(v)
+		case "define":
+			c.defines[fields[1]] = uint16(v)
+		default:
+			return nil
+		}
+	}
+	if sc.Err() != nil {
+		return nil
+	}
+	return c
+}
+
+// writeCache saves every label and define value in s to the cache file.
+func writeCache(name, key string, s *AssemblyState) error {
+	lines := make([]string, 0, len(s.labels)+len(s.symbols))
+	for label, lr := range s.labels {
+		lines = append(lines, fmt.Sprintf("label %s %04x", label, lr.value))
+	}
+	for symbol, lr := range s.symbols {
+		lines = append(lines, fmt.Sprintf("define %s %04x", symbol, lr.value))
+	}
+	sort.Strings(lines)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s\nkey %s\n", cacheHeader, key)
+	for _, l := range lines {
+		fmt.Fprintln(&b, l)
+	}
+	return os.WriteFile(name, []byte(b.String()), 0644)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCacheKeyScanning(t *testing.T) {
+	// The same text scans differently under these, so a cache from one
+	// mustn't be used for another.
+	const src = ":msg .dat 1\n.dat msg.len // x\n"
+	key := func(set func(*Scanner)) string {
+		sc := NewScanner("test.asm", strings.NewReader(src))
+		set(sc)
+		return cacheKey([]byte(src), &AST{}, Options{}, sc)
+	}
+	plain := key(func(*Scanner) {})
+	if again := key(func(*Scanner) {}); again != plain {
+		t.Errorf("the same settings gave different keys")
+	}
+	for name, set := range map[string]func(*Scanner){
+		"-alt-comments":   func(s *Scanner) { s.altComments = true },
+		"-ident-chars .":  func(s *Scanner) { s.identChars = "." },
+		"-ident-chars .$": func(s *Scanner) { s.identChars = ".$" },
+	} {
+		if key(set) == plain {
+			t.Errorf("%s gave the same key as the defaults", name)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// charset is the -charset flag: the code points that strings in .DAT and
+// .BYTE may use, for targets whose font only covers some of them. Empty means
+// anything goes.
+type charset []addrRange
+
+func (c *charset) String() string {
+	parts := make([]string, len(*c))
+	for i, r := range *c {
+		parts[i] = r.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set takes ascii, for 0x00-0x7f, or a comma-separated list of LO-HI ranges.
+func (c *charset) Set(text string) error {
+	if strings.EqualFold(text, "ascii") {
+		*c = charset{{0, 0x7f}}
+		return nil
+	}
+	var ranges charset
+	for _, part := range strings.Split(text, ",") {
+		r, err := parseAddrRange(part)
+		if err != nil {
+			return err
+		}
+		ranges = append(ranges, r)
+	}
+	*c = ranges
+	return nil
+}
+
+func (c charset) allows(ch rune) bool {
+	for _, r := range c {
+		if ch <= 0xffff && r.contains(uint16(ch)) {
+			return true
+		}
+	}
+	return false
+}
+
+// StringUse is a string that's expanded into .DAT or .BYTE values, with where
+// it's used, for checking against -charset.
+type StringUse struct {
+	text string
+	loc  Position
+}
+
+// checkCharset warns about strings in the program with characters outside the
+// -charset, naming each of them once.
+func checkCharset(ast *AST, s *AssemblyState) {
+	for _, u := range ast.Strings {
+		var bad []string
+		seen := make(map[rune]bool)
+		for _, ch := range u.text {
+			if !seen[ch] && !s.opts.Charset.allows(ch) {
+				bad = append(bad, fmt.Sprintf("'%c' (U+%04X)", ch, ch))
+			}
+			seen[ch] = true
+		}
+		if len(bad) > 0 {
+			s.warn(u.loc, "String has characters outside the -charset %s: %s", s.opts.Charset.String(), strings.Join(bad, ", "))
+		}
+	}
+}
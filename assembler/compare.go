@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// writeComparison compares the assembled program with ref, a binary from
+// another assembler, for -compare. It reports the first word that differs,
+// with the source line that wrote it and how the instruction there decodes on
+// each side, and returns whether the two match.
+func writeComparison(w io.Writer, ast *AST, s *AssemblyState, ref []uint16, refName string) bool {
+	ours := imageWords(s)
+	first, differ := -1, 0
+	for i := 0; i < len(ours) && i < len(ref); i++ {
+		if ours[i] != ref[i] {
+			if first < 0 {
+				first = i
+			}
+			differ++
+		}
+	}
+	if first < 0 && len(ours) != len(ref) {
+		// One is the other with more on the end.
+		first = min(len(ours), len(ref))
+	}
+	if first < 0 {
+		fmt.Fprintf(w, "Matches %s: %d words\n", refName, len(ours))
+		return true
+	}
+
+	addr := uint16(first)
+	where := "padding; no line wrote it"
+	start, loc, ok := lineAt(ast, s, addr)
+	if ok {
+		where = fmt.Sprintf("%s:%d", loc.File, loc.Line)
+	} else if first >= len(ours) {
+		where = "past the end of the program"
+	}
+	// A line can write several instructions, or data; decode from the one
+	// that holds addr.
+	for start < addr {
+		_, n := disassemble(ours[start:], start)
+		if addr-start < uint16(n) {
+			break
+		}
+		start += uint16(n)
+	}
+	fmt.Fprintf(w, "First difference at 0x%04x (%s):\n", addr, where)
+	width := max(len("ours"), len(refName))
+	fmt.Fprintf(w, "  %-*s  %s\n", width, "ours", decodeAt(ours, start))
+	fmt.Fprintf(w, "  %-*s  %s\n", width, refName, decodeAt(ref, start))
+	fmt.Fprintf(w, "%d of the %d words in both differ", differ, min(len(ours), len(ref)))
+	if len(ours) != len(ref) {
+		fmt.Fprintf(w, ", and the program is %d words where %s is %d", len(ours), refName, len(ref))
+	}
+	fmt.Fprintln(w)
+	return false
+}
+
+// lineAt runs one more pass, as writeListing does, to find the line that wrote
+// the word at addr. It returns the address that line starts at, so that addr
+// can be decoded as part of the instruction it's in, and the line's position.
+func lineAt(ast *AST, s *AssemblyState, addr uint16) (uint16, Position, bool) {
+	s.reset()
+	for i, l := range ast.Lines {
+		start := s.index
+		l.Assemble(s)
+		switch l.(type) {
+		case *Org, *Reserve:
+			continue // They move the index without writing anything.
+		}
+		if addr-start < s.index-start {
+			return start, Position{ast.SourceFiles[i], int(ast.SourceLines[i]), 1}, true
+		}
+	}
+	return addr, Position{}, false
+}
+
+// decodeAt disassembles the instruction at addr in words, as disasm would.
+func decodeAt(words []uint16, addr uint16) string {
+	if int(addr) >= len(words) {
+		return "(ends before here)"
+	}
+	text, n := disassemble(words[addr:], addr)
+	enc := make([]string, n)
+	for j := range enc {
+		enc[j] = fmt.Sprintf("%04x", words[int(addr)+j])
+	}
+	return fmt.Sprintf("%04x  %-9s  %s", addr, strings.Join(enc, " "), text)
+}
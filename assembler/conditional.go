@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// .IFDEF and .IFNDEF are settled as the source is parsed, so the lines they
+// leave out never reach the AST: they aren't assembled, their labels don't
+// exist, and the names they use needn't be defined. A name counts as defined if
+// a label, .DEFINE, .CONST, .SET, string .DEFINE or .DEFINEREG for it comes
+// earlier in the source, or it's in the -defines.
+
+// condBlock is an .IFDEF or .IFNDEF the parser is inside.
+type condBlock struct {
+	directive string
+	loc       Position
+	depth     int  // How many .INCLUDEs deep it started, since it must end in the same file.
+	outer     bool // Whether the lines around it are kept.
+	taken     bool // Whether its condition held, so the lines before any .ELSE are kept.
+	inElse    bool
+}
+
+// keep reports whether lines here are kept, rather than skipped by an
+// .IFDEF or .IFNDEF.
+func (p *Parser) keep() bool {
+	if n := len(p.conds); n > 0 {
+		c := p.conds[n-1]
+		return c.outer && c.taken != c.inElse
+	}
+	return true
+}
+
+// predefine makes names count as defined for .IFDEF, for the -defines, which
+// the parser doesn't otherwise see.
+func (p *Parser) predefine(names map[string]uint16) {
+	for name := range names {
+		p.defined[name] = true
+	}
+}
+
+// noteDefined records the name l defines, if any, for .IFDEF.
+func (p *Parser) noteDefined(l Assembled) {
+	switch d := l.(type) {
+	case *LabelDef:
+		p.defined[d.label] = true
+	case *SymbolDef:
+		p.defined[d.name] = true
+	case *StringDef:
+		p.defined[d.name] = true
+	case *RegAliasDef:
+		p.defined[d.name] = true
+	}
+}
+
+// conditional handles .IFDEF, .IFNDEF, .ELSE and .ENDIF, just after the dot.
+// For any other directive it reads nothing and reports false.
+func (p *Parser) conditional() (bool, error) {
+	t, lit := p.scan()
+	dir := strings.ToUpper(lit)
+	if t != IDENT || (dir != "IFDEF" && dir != "IFNDEF" && dir != "ELSE" && dir != "ENDIF") {
+		p.unscan()
+		return false, nil
+	}
+	loc := p.pos()
+	n := len(p.conds)
+
+	switch dir {
+	case "IFDEF", "IFNDEF":
+		t, name := p.scanIgnoreWhitespace()
+		if t != IDENT {
+			return true, fmt.Errorf(".%s needs a name; found %s", dir, tokenNames[t])
+		}
+		p.conds = append(p.conds, &condBlock{dir, loc, len(p.includers), p.keep(), p.defined[name] == (dir == "IFDEF"), false})
+	case "ELSE":
+		if n == 0 || p.conds[n-1].depth != len(p.includers) {
+			return true, fmt.Errorf(".ELSE without an .IFDEF or .IFNDEF in the same file")
+		} else if c := p.conds[n-1]; c.inElse {
+			return true, fmt.Errorf("The .%s at %s already has an .ELSE", c.directive, c.loc)
+		}
+		p.conds[n-1].inElse = true
+	case "ENDIF":
+		if n == 0 || p.conds[n-1].depth != len(p.includers) {
+			return true, fmt.Errorf(".ENDIF without an .IFDEF or .IFNDEF in the same file")
+		}
+		p.conds = p.conds[:n-1]
+	}
+	if !p.consumeEOL() {
+		t, lit := p.scanIgnoreWhitespace()
+		return true, fmt.Errorf("Unexpected %s '%s' at end of %s", tokenNames[t], lit, dir)
+	}
+	return true, nil
+}
+
+// unclosed returns an error for an .IFDEF or .IFNDEF still open at the end of
+// the current file, if there is one.
+func (p *Parser) unclosed() error {
+	if n := len(p.conds); n > 0 && p.conds[n-1].depth == len(p.includers) {
+		c := p.conds[n-1]
+		return &Error{c.loc, fmt.Sprintf(".%s has no .ENDIF before the end of the file", c.directive)}
+	}
+	return nil
+}
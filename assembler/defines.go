@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// readDefines reads a file of NAME = value lines, for -defines. Blank lines
+// and anything after # or ; are ignored. Each value is a constant expression.
+func readDefines(filename string) (map[string]uint16, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	defs := make(map[string]uint16)
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := sc.Text()
+		if i := strings.IndexAny(text, "#;"); i >= 0 {
+			text = text[:i]
+		}
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		loc := Position{filename, line, 1}
+		name, value, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, &Error{loc, fmt.Sprintf("Expected NAME = value, but found '%s'", strings.TrimSpace(text))}
+		}
+		name = strings.TrimSpace(name)
+		if !isIdentifier(name) {
+			return nil, &Error{loc, fmt.Sprintf("'%s' is not a valid name", name)}
+		}
+		v, err := parseConstant(strings.TrimSpace(value))
+		if err != nil {
+			return nil, &Error{loc, fmt.Sprintf("Bad value for %s: %v", name, err)}
+		}
+		defs[name] = v
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return defs, nil
+}
+
+// isIdentifier reports whether name could be written as a label or define.
+func isIdentifier(name string) bool {
+	for i, ch := range name {
+		if !isLetter(ch) && ch != '_' && (i == 0 || !isDigit(ch)) {
+			return false
+		}
+	}
+	_, reserved := keywords[strings.ToUpper(name)]
+	return name != "" && !reserved
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Diagnostic is a single error or warning, in a form editors can use to
+// highlight the offending source.
+type Diagnostic struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Col      int    `json:"col"`
+	Severity string `json:"severity"` // "error" or "warning"
+	Message  string `json:"message"`
+}
+
+// writeDiagnostics writes err (which may be a single *Error or an ErrorList)
+// and the warnings to w, as a JSON array of Diagnostics.
+func writeDiagnostics(w io.Writer, err error, warnings ErrorList) error {
+	diags := make([]Diagnostic, 0, len(warnings)+1)
+	add := func(e *Error, severity string) {
+		diags = append(diags, Diagnostic{e.Pos.File, e.Pos.Line, e.Pos.Col, severity, e.Msg})
+	}
+
+	switch e := err.(type) {
+	case nil:
+	case *Error:
+		add(e, "error")
+	case ErrorList:
+		for _, x := range e {
+			add(x, "error")
+		}
+	default:
+		diags = append(diags, Diagnostic{Severity: "error", Message: err.Error()})
+	}
+	for _, x := range warnings {
+		add(x, "warning")
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(diags)
+}
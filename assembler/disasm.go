@@ -0,0 +1,195 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var (
+	disasmFlags = flag.NewFlagSet("disasm", flag.ExitOnError)
+	disasmOrg   = disasmFlags.String("org", "0", "Address of the first word in the binary")
+	disasmCase  textCase
+)
+
+func runDisasm(args []string) {
+	origin, err := parseConstant(*disasmOrg)
+	if err != nil {
+		fmt.Printf("Error: bad -org: %v\n", err)
+		os.Exit(1)
+	}
+	words, err := readWords(args[0])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	writeDisassembly(os.Stdout, words, origin, disasmCase)
+}
+
+// readWords reads a big-endian binary, like out.bin, as 16-bit words.
+func readWords(name string) ([]uint16, error) {
+	bin, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if len(bin)%2 != 0 {
+		return nil, fmt.Errorf("%s has an odd number of bytes; expected 16-bit words", name)
+	}
+	words := make([]uint16, len(bin)/2)
+	for i := range words {
+		words[i] = uint16(bin[2*i])<<8 | uint16(bin[2*i+1])
+	}
+	return words, nil
+}
+
+// writeDisassembly prints each instruction in words, which start at address
+// origin, alongside its address and encoding, with mnemonics and registers in
+// case c.
+func writeDisassembly(w io.Writer, words []uint16, origin uint16, c textCase) {
+	for i := 0; i < len(words); {
+		text, n := disassemble(words[i:], origin+uint16(i))
+		text = applyCase(text, c)
+		enc := make([]string, n)
+		for j := range enc {
+			enc[j] = fmt.Sprintf("%04x", words[i+j])
+		}
+		fmt.Fprintf(w, "%04x  %-9s  %s\n", origin+uint16(i), strings.Join(enc, " "), text)
+		i += n
+	}
+}
+
+// Reverse lookups of the instruction tables, from op number to mnemonic.
+var (
+	riNames     = invertTable(riInstructions)
+	rrrNames    = invertTable(rrrInstructions)
+	rrNames     = invertTable(rrInstructions)
+	rNames      = invertTable(rInstructions)
+	voidNames   = invertTable(voidInstructions)
+	branchNames = invertTable(branchInstructions)
+)
+
+// invertTable maps each op number back to its name. Should two names ever
+// share a number, the first alphabetically wins, so the output doesn't depend on
+// map order.
+func invertTable(table map[string]uint16) map[uint16]string {
+	names := make(map[uint16]string, len(table))
+	for name, op := range table {
+		if old, ok := names[op]; !ok || name < old {
+			names[op] = name
+		}
+	}
+	return names
+}
+
+// disassemble decodes the instruction at the start of words, which is at
+// address addr. It returns the instruction's text and how many words it used.
+// Anything that isn't a valid instruction comes out as a .DAT.
+func disassemble(words []uint16, addr uint16) (string, int) {
+	w := words[0]
+	invalid := fmt.Sprintf(".dat 0x%04x", w)
+
+	switch {
+	case w&0x8000 == 0: // Immediate: 0oooodddXXXXXXXX
+		op, d, imm := (w>>11)&0xf, (w>>8)&7, w&0xff
+		switch op {
+		case 0:
+			switch d {
+			case 0:
+				return fmt.Sprintf("ADD SP, #%d", imm), 1
+			case 1:
+				return fmt.Sprintf("SUB SP, #%d", imm), 1
+			case 2:
+				return fmt.Sprintf("SWI #%d", imm), 1
+			}
+			return invalid, 1
+		case 0xd:
+			return fmt.Sprintf("ADD r%d, PC, #%d", d, imm), 1
+		case 0xe:
+			return fmt.Sprintf("ADD r%d, SP, #%d", d, imm), 1
+		}
+		return fmt.Sprintf("%s r%d, #%d", riNames[op], d, imm), 1
+
+	case w&0xe000 == 0x8000: // Registers: 100oooobbbaaaddd
+		op, b, a, d := (w>>9)&0xf, (w>>6)&7, (w>>3)&7, w&7
+		if op != 0 {
+			if name, ok := rrrNames[op]; ok {
+				return fmt.Sprintf("%s r%d, r%d, r%d", name, d, a, b), 1
+			}
+		} else if b != 0 {
+			return fmt.Sprintf("%s r%d, r%d", rrNames[b], d, a), 1
+		} else if a != 0 {
+			return fmt.Sprintf("%s r%d", rNames[a], d), 1
+		} else if name, ok := voidNames[d]; ok {
+			return name, 1
+		}
+		return invalid, 1
+
+	case w&0xe000 == 0xa000: // Branch: 101ooooXXXXXXXXX
+		name := branchNames[(w>>9)&0xf]
+		off := w & 0x1ff
+		if off == 0x1ff {
+			// Long form, with the absolute target in the next word.
+			if len(words) < 2 {
+				return invalid, 1
+			}
+			return fmt.Sprintf("%s 0x%04x", name, words[1]), 2
+		}
+		if off&0x100 != 0 {
+			off |= 0xfe00 // Sign-extend.
+		}
+		return fmt.Sprintf("%s 0x%04x", name, addr+1+off), 1
+
+	case w&0xe000 == 0xc000: // Memory: 110ooodddbbbXXXX
+		op, d, b, x := (w>>10)&7, (w>>7)&7, (w>>4)&7, w&0xf
+		name := "LDR"
+		if op&1 != 0 {
+			name = "STR"
+		}
+		switch op >> 1 {
+		case 0:
+			if x == 0 {
+				return fmt.Sprintf("%s r%d, [r%d]", name, d, b), 1
+			}
+			return fmt.Sprintf("%s r%d, [r%d], #%d", name, d, b, x), 1
+		case 1:
+			return fmt.Sprintf("%s r%d, [r%d, #%d]", name, d, b, x), 1
+		case 2:
+			if x&8 != 0 {
+				return invalid, 1
+			}
+			return fmt.Sprintf("%s r%d, [r%d, r%d]", name, d, b, x), 1
+		}
+		return fmt.Sprintf("%s r%d, [SP, #%d]", name, d, w&0x7f), 1
+
+	default: // Multi-store: 111oobbbrrrrrrrr
+		op, b, regs := (w>>11)&3, (w>>8)&7, w&0xff
+		var list []string
+		for r := 0; r < 8; r++ {
+			if regs&(1<<uint(r)) != 0 {
+				list = append(list, fmt.Sprintf("r%d", r))
+			}
+		}
+		// For PUSH and POP, bbb is 00P: whether to include LR or PC.
+		pclr := op < 2 && b == 1
+		if len(list) == 0 && !pclr || op < 2 && b > 1 {
+			return invalid, 1 // An empty list is illegal.
+		}
+		switch op {
+		case 0:
+			if pclr {
+				list = append(list, "PC")
+			}
+			return fmt.Sprintf("POP {%s}", strings.Join(list, ", ")), 1
+		case 1:
+			if pclr {
+				list = append(list, "LR")
+			}
+			return fmt.Sprintf("PUSH {%s}", strings.Join(list, ", ")), 1
+		case 2:
+			return fmt.Sprintf("LDMIA r%d, {%s}", b, strings.Join(list, ", ")), 1
+		}
+		return fmt.Sprintf("STMIA r%d, {%s}", b, strings.Join(list, ", ")), 1
+	}
+}
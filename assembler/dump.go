@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	dumpFlags     = flag.NewFlagSet("dump", flag.ExitOnError)
+	dumpTokens    = dumpFlags.Bool("tokens", false, "Print the tokens the scanner finds, instead of the AST")
+	dumpRawIdents = dumpFlags.Bool("raw-idents", false, "With -tokens, leave register names, PC, SP and LR as identifiers")
+)
+
+func runDump(args []string) {
+	if *dumpTokens {
+		dumpTokenList(args[0])
+		return
+	}
+	ast := openSource(args[0])
+	for i, l := range ast.Lines {
+		fmt.Printf("%5d  %s\n", ast.SourceLines[i], describeLine(l))
+	}
+}
+
+// dumpTokenList prints each token in file with its position and text, for
+// checking the lexer or feeding a syntax highlighter.
+func dumpTokenList(file string) {
+	f, err := os.Open(file)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	s := NewScanner(file, bufio.NewReader(f))
+	s.rawIdents = *dumpRawIdents
+	for _, t := range s.Tokens() {
+		fmt.Printf("%-8s %-10s %q\n", fmt.Sprintf("%d:%d", t.Pos.Line, t.Pos.Col), tokenNames[t.Token], t.Lit)
+	}
+}
+
+// describeLine gives the type of an AST line and its contents.
+func describeLine(l Assembled) string {
+	switch l := l.(type) {
+	case *LabelDef:
+		return fmt.Sprintf("LabelDef %s", l.label)
+	case *Instruction:
+		args := make([]string, len(l.args))
+		for i, a := range l.args {
+			args[i] = describeArg(a)
+		}
+		return fmt.Sprintf("Instruction %s %s", l.opcode, strings.Join(args, ", "))
+	case *LoadStore:
+		pre, post := "-", "-"
+		if l.preLit != nil {
+			pre = describeExpr(l.preLit)
+		} else if l.preReg != 0xffff {
+			pre = fmt.Sprintf("r%d", l.preReg)
+		}
+		if l.postLit != nil {
+			post = describeExpr(l.postLit)
+		}
+		base := "SP"
+		if l.base != 0xffff {
+			base = fmt.Sprintf("r%d", l.base)
+		}
+		return fmt.Sprintf("LoadStore storing=%t dest=r%d base=%s pre=%s post=%s", l.storing, l.dest, base, pre, post)
+	case *StackOp:
+		base := "SP"
+		if l.base != 0xffff {
+			base = fmt.Sprintf("r%d", l.base)
+		}
+		return fmt.Sprintf("StackOp storing=%t base=%s regs=%08b lr/pc=%t", l.storing, base, l.regs, l.lrpc)
+	case *DatBlock:
+		return "DatBlock " + describeExprs(l.values)
+	case *ByteBlock:
+		return "ByteBlock " + describeExprs(l.values)
+	case *RawWord:
+		return fmt.Sprintf("RawWord %s opcode=%t", describeExpr(l.value), l.opcode)
+	case *FillBlock:
+		return fmt.Sprintf("FillBlock length=%s value=%s", describeExpr(l.length), describeExpr(l.value))
+	case *Align:
+		return "Align " + describeExpr(l.boundary)
+	case *PadValue:
+		return "PadValue " + describeExpr(l.value)
+	case *Reserve:
+		return "Reserve " + describeExpr(l.length)
+	case *Include:
+		return fmt.Sprintf("Include %s", l.filename)
+	case *IncBin:
+		return fmt.Sprintf("IncBin %d bytes, order %d", len(l.data), l.order)
+	case *Endian:
+		return fmt.Sprintf("Endian little=%t", l.little)
+	case *Org:
+		return "Org " + describeExpr(l.loc)
+	case *SymbolDef:
+		if l.locked {
+			return fmt.Sprintf("SymbolDef const %s = %s", l.name, describeExpr(l.value))
+		} else if l.variable {
+			return fmt.Sprintf("SymbolDef set %s = %s", l.name, describeExpr(l.value))
+		}
+		return fmt.Sprintf("SymbolDef %s = %s", l.name, describeExpr(l.value))
+	case *StringDef:
+		return fmt.Sprintf("StringDef %s = %q", l.name, l.text)
+	case *RegAliasDef:
+		return fmt.Sprintf("RegAliasDef %s = r%d", l.name, l.reg)
+	case *StringEncoding:
+		return "StringEncoding " + l.mode
+	case *Message:
+		return fmt.Sprintf("Message fatal=%t %q", l.fatal, l.msg)
+	case *Assert:
+		return fmt.Sprintf("Assert %s %q", describeExpr(l.cond), l.msg)
+	}
+	return fmt.Sprintf("%T", l)
+}
+
+func describeArg(a *Arg) string {
+	switch a.kind {
+	case AT_LITERAL:
+		return "#" + describeExpr(a.lit)
+	case AT_LABEL:
+		return describeExpr(a.label)
+	}
+	return showArg(a)
+}
+
+func describeExprs(exprs []Expression) string {
+	strs := make([]string, len(exprs))
+	for i, e := range exprs {
+		strs[i] = describeExpr(e)
+	}
+	return strings.Join(strs, ", ")
+}
+
+// describeExpr writes an expression back out, fully bracketed.
+func describeExpr(e Expression) string {
+	switch e := e.(type) {
+	case *Constant:
+		return fmt.Sprint(e.value)
+	case *LabelUse:
+		return e.label
+	case *AddressOf:
+		return "=" + e.label.label
+	case *LabelAttr:
+		return e.label.label + "." + e.attr
+	case *Here:
+		return "$"
+	case *PackedBytes:
+		return fmt.Sprintf("packed(0x%02x, 0x%02x)", e.first, e.second)
+	case *Call:
+		return fmt.Sprintf("%s(%s)", e.name, describeExpr(e.arg))
+	case *Annotated:
+		if e.signed {
+			return "s" + describeExpr(e.expr)
+		}
+		return "u" + describeExpr(e.expr)
+	case *BinExpr:
+		return fmt.Sprintf("(%s %s %s)", describeExpr(e.lhs), tokenNames[e.operator], describeExpr(e.rhs))
+	case *UnaryExpr:
+		return tokenNames[e.operator] + describeExpr(e.expr)
+	}
+	return fmt.Sprintf("%T", e)
+}
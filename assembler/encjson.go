@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// EncodedInstruction records how an instruction was assembled, for -encjson.
+// Debuggers can use it to map addresses back to the source.
+type EncodedInstruction struct {
+	Mnemonic string           `json:"mnemonic"`
+	Operands []EncodedOperand `json:"operands"`
+	Encoder  string           `json:"encoder"` // As for -trace-encoding.
+	Words    []uint16         `json:"words"`
+	File     string           `json:"file"`
+	Line     int              `json:"line"`
+	Col      int              `json:"col"`
+}
+
+// EncodedOperand is one operand of an EncodedInstruction. Registers have their
+// number as the value; literals and labels their final value.
+type EncodedOperand struct {
+	Kind  string `json:"kind"` // "reg", "pc", "sp", "rlist", "literal" or "label"
+	Value uint16 `json:"value"`
+}
+
+// recordEncoding adds op, which was just assembled from start up to the
+// current index, to s.encodings.
+func recordEncoding(s *AssemblyState, op *Instruction, encoder string, start uint16) {
+	ei := &EncodedInstruction{
+		Mnemonic: op.opcode,
+		Operands: make([]EncodedOperand, len(op.args)),
+		Encoder:  encoder,
+		Words:    make([]uint16, 0, 2),
+		File:     op.loc.File,
+		Line:     op.loc.Line,
+		Col:      op.loc.Col,
+	}
+	for a := start; a != s.index; a++ {
+		ei.Words = append(ei.Words, s.rom[a])
+	}
+	for i, a := range op.args {
+		switch a.kind {
+		case AT_REG:
+			ei.Operands[i] = EncodedOperand{"reg", a.reg}
+		case AT_PC:
+			ei.Operands[i] = EncodedOperand{"pc", 0}
+		case AT_SP:
+			ei.Operands[i] = EncodedOperand{"sp", 0}
+		case AT_RLIST:
+			ei.Operands[i] = EncodedOperand{"rlist", a.reg}
+		case AT_LITERAL:
+			ei.Operands[i] = EncodedOperand{"literal", a.lit.Evaluate(s)}
+		case AT_LABEL:
+			ei.Operands[i] = EncodedOperand{"label", a.label.Evaluate(s)}
+		}
+	}
+	s.encodings[start] = ei
+}
+
+// writeEncodingFile writes the -encjson file.
+func writeEncodingFile(name string, s *AssemblyState) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if err := writeEncodingJSON(f, s); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeEncodingJSON writes the instructions from the final pass to w, as a
+// JSON object keyed by address in hex.
+func writeEncodingJSON(w io.Writer, s *AssemblyState) error {
+	byAddr := make(map[string]*EncodedInstruction, len(s.encodings))
+	for addr, ei := range s.encodings {
+		byAddr[fmt.Sprintf("%04x", addr)] = ei
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(byAddr)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Error is a parse or assembly error, along with where in the source it
+// happened. Pos is kept separate from the message so that tools can use it
+// directly.
+type Error struct {
+	Pos Position
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return e.Pos.String() + " " + e.Msg
+}
+
+// ErrorList is a collection of errors, reported together.
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, e := range l {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Terminal colors for the caret under an error or warning.
+const (
+	colorRed    = "\x1b[31m"
+	colorYellow = "\x1b[33m"
+	colorReset  = "\x1b[0m"
+)
+
+// sourceLines caches the files that showSource has read, split into lines.
+var sourceLines = make(map[string][]string)
+
+// showSource prints the source line at pos, with a caret under its column.
+// It prints nothing if the file can't be read. The caret is colored when w is
+// a terminal, unless NO_COLOR is set.
+func showSource(w io.Writer, pos Position, color string) {
+	lines, ok := sourceLines[pos.File]
+	if !ok {
+		src, err := os.ReadFile(pos.File)
+		if err == nil {
+			lines = strings.Split(string(src), "\n")
+		}
+		sourceLines[pos.File] = lines
+	}
+	if pos.Line < 1 || pos.Line > len(lines) {
+		return
+	}
+	line := strings.TrimRight(lines[pos.Line-1], "\r")
+
+	// Keep any tabs, so the caret lines up however they're displayed.
+	var pad strings.Builder
+	for i, ch := range line {
+		if i >= pos.Col-1 {
+			break
+		}
+		if ch == '\t' {
+			pad.WriteRune('\t')
+		} else {
+			pad.WriteRune(' ')
+		}
+	}
+
+	caret := "^"
+	if f, ok := w.(*os.File); ok && os.Getenv("NO_COLOR") == "" {
+		if st, err := f.Stat(); err == nil && st.Mode()&os.ModeCharDevice != 0 {
+			caret = color + caret + colorReset
+		}
+	}
+	fmt.Fprintf(w, "    %s\n    %s%s\n", line, pad.String(), caret)
+}
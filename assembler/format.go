@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	fmtFlags = flag.NewFlagSet("fmt", flag.ExitOnError)
+	fmtWrite = fmtFlags.Bool("w", false, "Write the result back to the file instead of printing it")
+	fmtCase  textCase
+)
+
+func runFmt(args []string) {
+	src, err := os.ReadFile(args[0])
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	out := formatSource(string(src), fmtCase)
+	if !*fmtWrite {
+		fmt.Print(out)
+		return
+	}
+	if err := os.WriteFile(args[0], []byte(out), 0644); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// formatSource lays out a source file consistently: labels at the start of the
+// line, everything else indented by two spaces, single spaces between words and
+// after commas, and no trailing or repeated blank lines. Comments are kept.
+// Mnemonics and registers are recased as c says.
+func formatSource(src string, c textCase) string {
+	var b strings.Builder
+	blank := false
+	for _, line := range strings.Split(src, "\n") {
+		line = formatLine(strings.TrimRight(line, "\r"), c)
+		if line == "" {
+			blank = b.Len() > 0
+			continue
+		}
+		if blank {
+			b.WriteString("\n")
+			blank = false
+		}
+		b.WriteString(line + "\n")
+	}
+	return b.String()
+}
+
+func formatLine(line string, c textCase) string {
+	indented := strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")
+	code, comment := splitComment(line)
+	code = applyCase(normalizeSpacing(code), c)
+
+	if code == "" {
+		if comment != "" && indented {
+			return "  " + comment
+		}
+		return comment
+	}
+	if !strings.HasPrefix(code, ":") {
+		code = "  " + code
+	}
+	if comment != "" {
+		code += " " + comment
+	}
+	return code
+}
+
+// splitComment splits a line at the first ; outside a string.
+func splitComment(line string) (string, string) {
+	inString := false
+	for i, ch := range line {
+		if ch == '"' {
+			inString = !inString
+		} else if ch == ';' && !inString {
+			return line[:i], strings.TrimRight(line[i:], " \t")
+		}
+	}
+	return line, ""
+}
+
+// normalizeSpacing collapses runs of whitespace outside strings to a single
+// space, and puts exactly one space after each comma and none before.
+func normalizeSpacing(code string) string {
+	var b strings.Builder
+	inString, space := false, false
+	for _, ch := range strings.TrimSpace(code) {
+		switch {
+		case inString:
+			b.WriteRune(ch)
+			inString = ch != '"'
+		case ch == ' ' || ch == '\t':
+			space = true
+		case ch == ',':
+			b.WriteString(", ")
+			space = false
+		default:
+			if space && !strings.HasSuffix(b.String(), " ") {
+				b.WriteRune(' ')
+			}
+			space = false
+			b.WriteRune(ch)
+			inString = ch == '"'
+		}
+	}
+	return strings.TrimRight(b.String(), " ")
+}
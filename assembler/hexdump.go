@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const hexdumpWidth = 8 // Words per line.
+
+// writeHexdump prints the assembled program in the style of hexdump -C: an
+// address, then 8 words, then the labels that fall on that line. Words that
+// weren't written show as "....", and runs of lines with no words or labels
+// at all are collapsed into a single "*".
+func writeHexdump(w io.Writer, s *AssemblyState) {
+	// Labels past the last word written, eg. an :end, still get a line.
+	size := s.size()
+	end := size
+	labels := make(map[uint16][]string)
+	for name, lr := range s.labels {
+		if !strings.HasPrefix(name, "@") { // Anonymous labels have no name.
+			labels[lr.value] = append(labels[lr.value], name)
+			if int(lr.value) >= end {
+				end = int(lr.value) + 1
+			}
+		}
+	}
+	for _, names := range labels {
+		sort.Strings(names)
+	}
+
+	skipped := false
+	for row := 0; row < end; row += hexdumpWidth {
+		words := make([]string, 0, hexdumpWidth)
+		var notes []string
+		empty := true
+		for a := row; a < row+hexdumpWidth && a < end; a++ {
+			if a < size && s.used[uint16(a)] {
+				words = append(words, fmt.Sprintf("%04x", s.rom[a]))
+				empty = false
+			} else {
+				words = append(words, "....")
+			}
+			for _, name := range labels[uint16(a)] {
+				notes = append(notes, fmt.Sprintf("%s=%04x", name, a))
+			}
+		}
+
+		if empty && len(notes) == 0 {
+			if !skipped {
+				fmt.Fprintln(w, "*")
+				skipped = true
+			}
+			continue
+		}
+		skipped = false
+
+		line := fmt.Sprintf("%04x  %-*s", row, hexdumpWidth*5-1, strings.Join(words, " "))
+		if len(notes) > 0 {
+			line += "  |" + strings.Join(notes, " ") + "|"
+		}
+		fmt.Fprintln(w, line)
+	}
+	fmt.Fprintf(w, "%04x\n", size)
+}
@@ -19,6 +19,8 @@ func showArg(arg *Arg) string {
 		return "PC"
 	case AT_SP:
 		return "SP"
+	case AT_LR:
+		return "LR"
 	case AT_REG:
 		return fmt.Sprintf("r%d", arg.reg)
 	case AT_LITERAL:
@@ -30,10 +32,27 @@ func showArg(arg *Arg) string {
 	}
 }
 
-func opRI(loc, mnemonic string, opcode uint16, args []*Arg, s *AssemblyState) {
+func opRI(loc Position, mnemonic string, opcode uint16, args []*Arg, s *AssemblyState) {
 	if mnemonic == "MOV" {
 		// Special case for MOV: We can encode it as NEG or as MOV+MVH.
-		value := args[1].lit.Evaluate(s)
+		// 0x0000-0x00ff fit as they are. 0xff01-0xffff are -255 to -1, which is
+		// NEG of 1-255. (NEG #0 is just 0, and 0xff00 would need NEG #256.)
+		// Everything else, 0x0100-0xff00, takes MOV of the low byte and MVH of
+		// the high byte.
+		// An external symbol always gets MOV+MVH, since its value isn't known.
+		if name, addend, ok := externalRef(s, args[1].lit); ok {
+			s.relocate(name, relocMovMVH, addend)
+			s.push(0x0800 | (args[0].reg << 8) | (addend & 0xff))
+			s.push(0x7800 | (args[0].reg << 8) | (addend >> 8))
+			return
+		}
+		if a, ok := args[1].lit.(*Annotated); ok {
+			annotatedValue(s, a)
+		}
+		value := narrow(s, args[1].lit)
+		if value > 255 && s.opts.NoOpCollapse {
+			asmError(loc, "MOV immediate %d (0x%x) doesn't fit in 8 bits; use MOV and MVH explicitly", value, value)
+		}
 		if value <= 255 {
 			s.push((opcode << 11) | (args[0].reg << 8) | value)
 		} else if value > 0xff00 {
@@ -48,38 +67,52 @@ func opRI(loc, mnemonic string, opcode uint16, args []*Arg, s *AssemblyState) {
 	}
 }
 
-func opRRR(loc, mnemonic string, opcode uint16, args []*Arg, s *AssemblyState) {
+func opRRR(loc Position, mnemonic string, opcode uint16, args []*Arg, s *AssemblyState) {
 	s.push(0x8000 | (opcode << 9) | (args[2].reg << 6) | (args[1].reg << 3) | args[0].reg)
 }
 
-func opRR(loc, mnemonic string, opcode uint16, args []*Arg, s *AssemblyState) {
+func opRR(loc Position, mnemonic string, opcode uint16, args []*Arg, s *AssemblyState) {
 	s.push(0x8000 | (opcode << 6) | (args[1].reg << 3) | args[0].reg)
 }
 
-func opR(loc, mnemonic string, opcode uint16, args []*Arg, s *AssemblyState) {
+func opR(loc Position, mnemonic string, opcode uint16, args []*Arg, s *AssemblyState) {
 	s.push(0x8000 | (opcode << 3) | args[0].reg)
 }
 
-func opVoid(loc, mnemonic string, opcode uint16, s *AssemblyState) {
+func opVoid(loc Position, mnemonic string, opcode uint16, s *AssemblyState) {
 	s.push(0x8000 | opcode)
 }
 
-func opBranch(loc, mnemonic string, opcode uint16, args []*Arg, s *AssemblyState) {
+func opBranch(loc Position, mnemonic string, opcode uint16, args []*Arg, s *AssemblyState) {
 	// Convert the argument to an absolute address.
-	target := args[0].label.Evaluate(s)
+	expr := args[0].label
+	if args[0].kind == AT_LITERAL {
+		expr = args[0].lit
+	}
+	if name, addend, ok := externalRef(s, expr); ok {
+		// External targets always take the long form.
+		s.push(0xa000 | (opcode << 9) | 0x1ff)
+		s.relocate(name, relocWord, addend)
+		s.push(addend)
+		return
+	}
+	target := narrow(s, expr)
+	// The offset is relative to the next instruction, which is where PC
+	// points while this one executes.
 	diff := target - (s.index + 1)
 	// Special case: if the diff happens to be -1, need to use the long form.
 	if diff != 0xffff && (diff < 256 || -diff <= 256) {
 		// Fits into the single instruction.
 		s.push(0xa000 | (opcode << 9) | (diff & 0x1ff))
 	} else {
-		// Needs the long form.
+		// Needs the long form. Every condition code has one, and the target
+		// can be any address, so there's nothing more to check.
 		s.push(0xa000 | (opcode << 9) | 0x1ff)
 		s.push(target)
 	}
 }
 
-func opAddSub(loc, mnemonic string, args []*Arg, s *AssemblyState) {
+func opAddSub(loc Position, mnemonic string, args []*Arg, s *AssemblyState) {
 	// ADD and SUB both support several argument types: RI, RRR, SP-Imm.
 	// ADD additionally has reg-PC-imm and reg-SP-imm
 	if len(args) == 2 && args[0].kind == AT_REG && args[1].kind == AT_LITERAL {
@@ -101,19 +134,33 @@ func opAddSub(loc, mnemonic string, args []*Arg, s *AssemblyState) {
 		value := checkLiteral(s, args[2].lit, false, 8)
 		s.push((0xe << 11) | (args[0].reg << 8) | value)
 	} else if len(args) == 2 && args[0].kind == AT_SP && args[1].kind == AT_LITERAL {
-		value := checkLiteral(s, args[1].lit, false, 8)
 		opcode := uint16(0)
 		if mnemonic == "SUB" {
 			opcode++
 		}
-		s.push((opcode << 8) | value)
+		// Stack adjustments are naturally signed, so ADD SP, #-4 is
+		// SUB SP, #4 and vice versa. The value is taken as written, so
+		// #0xfffc is 65532, and out of range, not -4.
+		n := wideValue(args[1].lit, s)
+		if a, ok := args[1].lit.(*Annotated); ok {
+			n = annotatedValue(s, a)
+		}
+		value := n
+		if value < 0 {
+			value = -value
+			opcode ^= 1
+		}
+		if value > 0xff {
+			asmError(args[1].lit.Location(), "%s SP immediate %d is out of range; the limit is 255 either way", mnemonic, n)
+		}
+		s.push((opcode << 8) | uint16(value))
 	} else {
 		// Unrecognized set of arguments.
 		asmError(loc, "Unrecognized arguments to %s: %s", mnemonic, showArgs(args))
 	}
 }
 
-func opSWI(loc, mnemonic string, args []*Arg, s *AssemblyState) {
+func opSWI(loc Position, mnemonic string, args []*Arg, s *AssemblyState) {
 	// SWI accepts either a single register or a literal.
 	if len(args) == 1 && args[0].kind == AT_REG {
 		// 1000000000011ddd
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// assembleWords assembles src and returns its words, or the error.
+func assembleWords(t *testing.T, src string) ([]uint16, error) {
+	t.Helper()
+	b, _, err := AssembleBytes("test.asm", strings.NewReader(src), Options{}, binary.BigEndian)
+	if err != nil {
+		return nil, err
+	}
+	words := make([]uint16, len(b)/2)
+	for i := range words {
+		words[i] = binary.BigEndian.Uint16(b[2*i:])
+	}
+	return words, nil
+}
+
+// wordTest is a single line of source, and the one word it assembles to or a
+// part of the error it gives.
+type wordTest struct {
+	src  string
+	want uint16
+	err  string
+}
+
+func checkWords(t *testing.T, tests []wordTest) {
+	t.Helper()
+	for _, tc := range tests {
+		words, err := assembleWords(t, "  "+tc.src+"\n")
+		switch {
+		case tc.err != "":
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: got error %v, want %q", tc.src, err, tc.err)
+			}
+		case err != nil:
+			t.Errorf("%s: unexpected error %v", tc.src, err)
+		case len(words) != 1 || words[0] != tc.want:
+			t.Errorf("%s: got %04x, want %04x", tc.src, words, tc.want)
+		}
+	}
+}
+
+func TestSPImmediate(t *testing.T) {
+	tests := []wordTest{
+		{src: "add sp, #8", want: 0x0008},
+		{src: "sub sp, #8", want: 0x0108},
+		{src: "add sp, #-8", want: 0x0108},
+		{src: "sub sp, #-8", want: 0x0008},
+		{src: "sub sp, #-255", want: 0x00ff},
+		{src: "add sp, #s-4", want: 0x0104},
+		// The value is taken as written, not cut down to 16 bits signed first.
+		{src: "add sp, #0x8000", err: "ADD SP immediate 32768 is out of range"},
+		{src: "add sp, #0xfff8", err: "ADD SP immediate 65528 is out of range"},
+		{src: "sub sp, #256", err: "SUB SP immediate 256 is out of range"},
+		{src: "sub sp, #-256", err: "SUB SP immediate -256 is out of range"},
+	}
+	checkWords(t, tests)
+}
+
+func TestLoadStoreOffset(t *testing.T) {
+	tests := []wordTest{
+		{src: "ldr r0, [r1, #15]", want: 0xc81f},
+		{src: "ldr r0, [r1], #15", want: 0xc01f},
+		{src: "str r0, [sp, #127]", want: 0xdc7f},
+		// No form takes a negative offset, and the error says so.
+		{src: "ldr r0, [r1, #-2]", err: "Load/store offsets are unsigned; negative offset -2 is not supported"},
+		{src: "ldr r0, [r1], #-2", err: "Load/store offsets are unsigned; negative offset -2 is not supported"},
+		{src: "str r0, [sp, #-1]", err: "Load/store offsets are unsigned; negative offset -1 is not supported"},
+		{src: "ldr r0, [r1, #16]", err: "the limit is 15 (4 bits)"},
+		{src: "ldr r0, [sp, #128]", err: "the limit is 127 (7 bits)"},
+	}
+	checkWords(t, tests)
+}
+
+func TestVoidInstructions(t *testing.T) {
+	checkWords(t, []wordTest{
+		{src: "rfi", want: 0x8000},
+		{src: "ifs", want: 0x8001},
+		{src: "ifc", want: 0x8002},
+		{src: "ret", want: 0x8003},
+		{src: "popsp", want: 0x8004},
+		{src: "brk", want: 0x8005},
+		// None of them has a form with an operand.
+		{src: "ret r0", err: "RET takes no operands, but found r0"},
+		{src: "brk #1", err: "BRK takes no operands"},
+		{src: "ifs r1, r2", err: "IFS takes no operands"},
+	})
+}
+
+func TestMultipleBaseInList(t *testing.T) {
+	checkWords(t, []wordTest{
+		{src: "ldmia r2, {r0, r3}", want: 0xf209},
+		{src: "stmia r2, {r0, r3}", want: 0xfa09},
+		// Writing back the base would clobber the register loaded into it.
+		{src: "ldmia r2, {r2, r3}", err: "Base register r2 can't also be in the register list for LDMIA"},
+		{src: "stmia r7, {r0, r7}", err: "Base register r7 can't also be in the register list for STMIA"},
+	})
+}
+
+func TestMovImmediate(t *testing.T) {
+	// Each row of the table in assembly.md, at both ends.
+	tests := []struct {
+		imm  string
+		want []uint16
+	}{
+		{"0", []uint16{0x0800}},                       // MOV
+		{"255", []uint16{0x08ff}},                     // MOV
+		{"256", []uint16{0x0800, 0x7801}},             // MOV+MVH
+		{"0x8000", []uint16{0x0800, 0x7880}},          // MOV+MVH
+		{"0xff00", []uint16{0x0800, 0x78ff}},          // MOV+MVH
+		{"-256", []uint16{0x0800, 0x78ff}},            // MOV+MVH, as 0xff00
+		{"0xff01", []uint16{0x10ff}},                  // NEG #255
+		{"-255", []uint16{0x10ff}},                    // NEG #255
+		{"0xffff", []uint16{0x1001}},                  // NEG #1
+		{"-1", []uint16{0x1001}},                      // NEG #1
+		{"0xff00 + 1", []uint16{0x10ff}},              // NEG #255
+		{"(1 << 16) - 256", []uint16{0x0800, 0x78ff}}, // MOV+MVH
+	}
+	for _, tc := range tests {
+		src := "  mov r0, #" + tc.imm + "\n"
+		words, err := assembleWords(t, src)
+		if err != nil {
+			t.Errorf("MOV r0, #%s: unexpected error %v", tc.imm, err)
+		} else if fmt.Sprint(words) != fmt.Sprint(tc.want) {
+			t.Errorf("MOV r0, #%s: got %04x, want %04x", tc.imm, words, tc.want)
+		}
+	}
+
+	// -no-op-collapse only allows the first row.
+	for imm, ok := range map[string]bool{"255": true, "256": false, "0xff01": false} {
+		src := "  mov r0, #" + imm + "\n"
+		_, _, err := AssembleBytes("test.asm", strings.NewReader(src), Options{NoOpCollapse: true}, binary.BigEndian)
+		if (err == nil) != ok {
+			t.Errorf("MOV r0, #%s with -no-op-collapse: got error %v", imm, err)
+		}
+	}
+}
+
+func TestBranchHash(t *testing.T) {
+	// B #label is accepted, and is the same as B label, in short and long form.
+	for _, src := range []string{
+		"  b %slabel\n:label",
+		"  bl %slabel\n  brk\n:label",
+		"  bne %slabel\n.fill 0, 300\n:label",
+		":label\n  beq %slabel",
+		"  b %s0x20",
+	} {
+		bare, err := assembleWords(t, fmt.Sprintf(src, ""))
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", fmt.Sprintf(src, ""), err)
+			continue
+		}
+		hash, err := assembleWords(t, fmt.Sprintf(src, "#"))
+		if err != nil || fmt.Sprint(hash) != fmt.Sprint(bare) {
+			t.Errorf("%q: got %04x, error %v; want %04x as without the #", fmt.Sprintf(src, "#"), hash, err, bare)
+		}
+	}
+}
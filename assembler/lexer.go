@@ -2,10 +2,10 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"fmt"
 	"io"
 	"strings"
+	"unicode/utf8"
 )
 
 type Token int
@@ -21,9 +21,11 @@ const (
 	PC
 	SP
 	LR
-	NUMBER // Immediates, .dat etc.
-	IDENT  // Labels
-	STRING // String literals
+	NUMBER    // Immediates, .dat etc.
+	IDENT     // Labels
+	STRING    // String literals
+	HEXSTRING // Byte strings in hex, x"DEADBEEF"
+	ANON      // Anonymous label references: 1f, 2b
 
 	// Punctuation
 	DOT
@@ -36,6 +38,8 @@ const (
 	RPAREN
 	LBRACE
 	RBRACE
+	EQUALS
+	DOLLAR // The current address
 
 	// Operators
 	PLUS
@@ -44,44 +48,62 @@ const (
 	DIVIDE
 	LANGLES
 	RANGLES
+	ASR // >>>, arithmetic shift right
 	AND
 	OR
 	XOR
 	NOT
+	EQ
+	NE
+	LT
+	LE
+	GT
+	GE
 )
 
 var tokenNames = map[Token]string{
-	ILLEGAL:  "<ILLEGAL>",
-	EOF:      "EOF",
-	WS:       "whitespace",
-	NEWLINE:  "newline",
-	REGISTER: "register",
-	PC:       "PC",
-	SP:       "SP",
-	LR:       "LR",
-	NUMBER:   "number",
-	IDENT:    "identifier",
-	STRING:   "string literal",
-	DOT:      "dot",
-	HASH:     "#",
-	COLON:    ":",
-	COMMA:    ",",
-	LBRAC:    "[",
-	RBRAC:    "]",
-	LBRACE:   "{",
-	RBRACE:   "}",
-	LPAREN:   "(",
-	RPAREN:   ")",
-	PLUS:     "+",
-	MINUS:    "-",
-	TIMES:    "*",
-	DIVIDE:   "/",
-	LANGLES:  "<<",
-	RANGLES:  ">>",
-	AND:      "&",
-	OR:       "|",
-	XOR:      "^",
-	NOT:      "~",
+	ILLEGAL:   "<ILLEGAL>",
+	EOF:       "EOF",
+	WS:        "whitespace",
+	NEWLINE:   "newline",
+	REGISTER:  "register",
+	PC:        "PC",
+	SP:        "SP",
+	LR:        "LR",
+	NUMBER:    "number",
+	IDENT:     "identifier",
+	STRING:    "string literal",
+	HEXSTRING: "hex byte string",
+	ANON:      "anonymous label reference",
+	DOT:       "dot",
+	HASH:      "#",
+	COLON:     ":",
+	COMMA:     ",",
+	LBRAC:     "[",
+	RBRAC:     "]",
+	LBRACE:    "{",
+	RBRACE:    "}",
+	EQUALS:    "=",
+	DOLLAR:    "$",
+	LPAREN:    "(",
+	RPAREN:    ")",
+	PLUS:      "+",
+	MINUS:     "-",
+	TIMES:     "*",
+	DIVIDE:    "/",
+	LANGLES:   "<<",
+	RANGLES:   ">>",
+	ASR:       ">>>",
+	AND:       "&",
+	OR:        "|",
+	XOR:       "^",
+	NOT:       "~",
+	EQ:        "==",
+	NE:        "!=",
+	LT:        "<",
+	LE:        "<=",
+	GT:        ">",
+	GE:        ">=",
 }
 
 // We'll put this EOF rune on the end of everything.
@@ -102,11 +124,40 @@ func isDigit(ch rune) bool {
 
 // Scanner is our lexer.
 type Scanner struct {
-	r       *bufio.Reader
-	file    string
-	line    uint
-	col     uint
-	noCount uint
+	r    *bufio.Reader
+	file string
+	line uint
+	col  uint
+
+	// Position before the last read, restored by unread.
+	prevLine uint
+	prevCol  uint
+
+	// Where the last token scanned began.
+	start Position
+
+	// The text of the token being scanned. It's reused from one token to the
+	// next, so the only allocation is the final string.
+	text []byte
+
+	// Also treat // and a # in the first column as starting a comment, for
+	// code written for other assemblers. # anywhere else is still a literal.
+	altComments bool
+
+	// Leave register names, PC, SP and LR as IDENT instead of promoting them
+	// to keywords, for tools like syntax highlighters that classify words
+	// themselves. The parser needs them promoted.
+	rawIdents bool
+
+	// Characters besides letters, digits and _ that can be in an identifier
+	// after its first character, for code written for other assemblers: any
+	// of . and $, from -ident-chars. A . here means label.len and label.end
+	// scan as single names.
+	identChars string
+
+	// The first malformed token found, if any. The scanner returns ILLEGAL for
+	// these, and the parser reports this more helpful error instead.
+	err *Error
 }
 
 func NewScanner(filename string, r io.Reader) *Scanner {
@@ -117,38 +168,96 @@ func NewScanner(filename string, r io.Reader) *Scanner {
 // Returns the rune(0) if an error occurs or io.EOF is returned.
 func (s *Scanner) read() rune {
 	ch, _, err := s.r.ReadRune()
+	s.prevLine, s.prevCol = s.line, s.col
 	if err != nil {
 		return eof
 	}
 
-	if s.noCount == 0 {
-		s.col++
-		if ch == '\n' {
-			s.col = 0
-			s.line++
-		}
-	} else {
-		s.noCount--
+	s.col++
+	if ch == '\n' {
+		s.col = 0
+		s.line++
 	}
 
 	return ch
 }
 
+// unread pushes back the last rune read. Only one rune can be unread at a time.
 func (s *Scanner) unread() {
 	_ = s.r.UnreadRune()
-	s.noCount++ // Avoids double-counting when we re-scan.
+	s.line, s.col = s.prevLine, s.prevCol
+}
+
+// peek returns the next rune without reading it.
+func (s *Scanner) peek() rune {
+	ch := s.read()
+	if ch != eof {
+		s.unread()
+	}
+	return ch
+}
+
+// keep adds ch to the text of the token being scanned.
+func (s *Scanner) keep(ch rune) {
+	s.text = utf8.AppendRune(s.text, ch)
+}
+
+// Position is a location in a source file.
+type Position struct {
+	File string
+	Line int
+	Col  int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
+}
+
+// Pos returns the scanner's current position.
+func (s *Scanner) Pos() Position {
+	return Position{s.file, int(s.line), int(s.col)}
 }
 
 func (s *Scanner) Location() string {
-	return fmt.Sprintf("%s:%d:%d", s.file, s.line, s.col)
+	return s.Pos().String()
+}
+
+// TokenPos returns where the last token scanned began.
+func (s *Scanner) TokenPos() Position {
+	return s.start
 }
 
 func (s *Scanner) Scan() (Token, string) {
+	s.start = Position{s.file, int(s.line), int(s.col) + 1}
 	t, l := s.innerScan()
-	fmt.Printf("%s - '%s'\n", tokenNames[t], l)
+	if verbose {
+		debugf("%s - '%s'\n", tokenNames[t], l)
+	}
 	return t, l
 }
 
+// Lexeme is a single scanned token, along with its literal text and where it
+// began.
+type Lexeme struct {
+	Token
+	Lit string
+	Pos Position
+}
+
+// Tokens runs the scanner to EOF, returning every token it found (not
+// including the final EOF). Handy for checking the lexer in isolation.
+func (s *Scanner) Tokens() []Lexeme {
+	var toks []Lexeme
+	for {
+		pos := Position{s.file, int(s.line), int(s.col) + 1}
+		t, l := s.innerScan()
+		if t == EOF {
+			return toks
+		}
+		toks = append(toks, Lexeme{t, l, pos})
+	}
+}
+
 func (s *Scanner) innerScan() (tok Token, lit string) {
 	ch := s.read()
 
@@ -173,6 +282,9 @@ func (s *Scanner) innerScan() (tok Token, lit string) {
 	case '.':
 		return DOT, string(ch)
 	case '#':
+		if s.altComments && s.col == 1 {
+			return s.scanComment(ch)
+		}
 		return HASH, string(ch)
 	case ':':
 		return COLON, string(ch)
@@ -190,8 +302,29 @@ func (s *Scanner) innerScan() (tok Token, lit string) {
 		return LPAREN, string(ch)
 	case ')':
 		return RPAREN, string(ch)
+	case '=':
+		if s.read() == '=' {
+			return EQ, "=="
+		}
+		s.unread()
+		return EQUALS, string(ch)
+	case '!':
+		if s.read() == '=' {
+			return NE, "!="
+		}
+		s.unread()
+		return ILLEGAL, string(ch)
+	case '$':
+		return DOLLAR, string(ch)
 	case '\n':
 		return NEWLINE, string(ch)
+	case '\r':
+		// A Windows line ending is a newline like any other.
+		if s.read() == '\n' {
+			return NEWLINE, "\n"
+		}
+		s.unread()
+		return ILLEGAL, string(ch)
 	case '+':
 		return PLUS, string(ch)
 	case '-':
@@ -199,6 +332,12 @@ func (s *Scanner) innerScan() (tok Token, lit string) {
 	case '*':
 		return TIMES, string(ch)
 	case '/':
+		if s.altComments {
+			if s.read() == '/' {
+				return s.scanComment(ch)
+			}
+			s.unread()
+		}
 		return DIVIDE, string(ch)
 	case '&':
 		return AND, string(ch)
@@ -209,34 +348,59 @@ func (s *Scanner) innerScan() (tok Token, lit string) {
 	case '~':
 		return NOT, string(ch)
 	case '<':
-		next := s.read()
-		if next == '<' {
+		switch s.read() {
+		case '<':
 			return LANGLES, "<<"
-		} else {
-			return ILLEGAL, string(ch) + string(next)
+		case '=':
+			return LE, "<="
 		}
+		s.unread()
+		return LT, string(ch)
 	case '>':
-		next := s.read()
-		if next == '>' {
+		switch s.read() {
+		case '>':
+			if s.read() == '>' {
+				return ASR, ">>>"
+			}
+			s.unread()
 			return RANGLES, ">>"
-		} else {
-			return ILLEGAL, string(ch) + string(next)
+		case '=':
+			return GE, ">="
 		}
+		s.unread()
+		return GT, string(ch)
 	case ';':
-		return s.scanWhile(func(c rune) bool { return c != '\n' }, WS)
+		return s.scanComment(ch)
 	case '"':
 		return s.scanStringLiteral()
 	}
 
-	fmt.Printf("%v\n", ch)
+	debugf("%v\n", ch)
 	return ILLEGAL, string(ch)
 }
 
+// scanComment skips the rest of a comment that began with first, up to but not
+// including the newline. Comments count as whitespace.
+func (s *Scanner) scanComment(first rune) (Token, string) {
+	s.text = s.text[:0]
+	s.keep(first)
+	for {
+		if ch := s.read(); ch == eof {
+			break
+		} else if ch == '\n' {
+			s.unread()
+			break
+		} else {
+			s.keep(ch)
+		}
+	}
+	return WS, string(s.text)
+}
+
 func (s *Scanner) scanWhile(p func(rune) bool, t Token) (Token, string) {
-	// Create a buffer and read the current character into it.
-	var buf bytes.Buffer
 	// Read the first character, which we know to be whitespace.
-	buf.WriteRune(s.read())
+	s.text = s.text[:0]
+	s.keep(s.read())
 	for {
 		if ch := s.read(); ch == eof {
 			break
@@ -244,10 +408,10 @@ func (s *Scanner) scanWhile(p func(rune) bool, t Token) (Token, string) {
 			s.unread()
 			break
 		} else {
-			buf.WriteRune(ch)
+			s.keep(ch)
 		}
 	}
-	return t, buf.String()
+	return t, string(s.text)
 }
 
 var keywords = map[string]Token{
@@ -265,45 +429,113 @@ var keywords = map[string]Token{
 }
 
 func (s *Scanner) scanIdent() (tok Token, lit string) {
-	var buf bytes.Buffer
-	buf.WriteRune(s.read())
+	s.text = s.text[:0]
+	s.keep(s.read())
 
 	for {
 		if ch := s.read(); ch == eof {
 			break
-		} else if !isLetter(ch) && !isDigit(ch) && ch != '_' {
+		} else if !isLetter(ch) && !isDigit(ch) && ch != '_' && !strings.ContainsRune(s.identChars, ch) {
 			s.unread()
 			break
 		} else {
-			_, _ = buf.WriteRune(ch)
+			s.keep(ch)
 		}
 	}
 
-	st := buf.String()
-	if t, ok := keywords[strings.ToUpper(st)]; ok {
-		return t, st
-	} else {
-		return IDENT, st
+	st := string(s.text)
+	// x"..." is a byte string, not the identifier x.
+	if st == "x" || st == "X" {
+		if s.read() == '"' {
+			tok, lit := s.scanStringLiteral()
+			if tok == STRING {
+				tok = HEXSTRING
+			}
+			return tok, lit
+		}
+		s.unread()
 	}
+	// The keywords are all two letters, so only those need upper-casing.
+	if len(st) == 2 && !s.rawIdents {
+		if t, ok := keywords[strings.ToUpper(st)]; ok {
+			return t, st
+		}
+	}
+	return IDENT, st
 }
 
+// scanNumber reads a decimal, 0x hex or 0b binary number. The whole run of
+// identifier characters is read, so that eg. 5foo is a malformed number rather
+// than 5 followed by an identifier.
 func (s *Scanner) scanNumber() (tok Token, lit string) {
-	var buf bytes.Buffer
-	ch := s.read()
-	firstZero := ch == '0'
-	count := 1
-	buf.WriteRune(ch)
+	start := s.Pos()
+	start.Col++ // Point at the first digit.
 
+	s.text = s.text[:0]
 	for {
-		ch = s.read()
-		if isHexDigit(ch) || (firstZero && count == 1 && ch == 'x') {
-			buf.WriteRune(ch)
-			count++
+		ch := s.read()
+		if isLetter(ch) || isDigit(ch) || ch == '_' {
+			s.keep(ch)
 		} else {
 			s.unread()
-			return NUMBER, buf.String()
+			break
+		}
+	}
+
+	lit = string(s.text)
+	if isAnonRef(lit) {
+		return ANON, lit
+	}
+
+	digits, valid := lit, isDigit
+	if len(lit) >= 2 && lit[0] == '0' && (lit[1] == 'x' || lit[1] == 'X') {
+		digits, valid = lit[2:], isHexDigit
+	} else if len(lit) >= 2 && lit[0] == '0' && (lit[1] == 'b' || lit[1] == 'B') {
+		digits, valid = lit[2:], func(ch rune) bool { return ch == '0' || ch == '1' }
+	}
+
+	ok := len(digits) > 0
+	for _, ch := range digits {
+		ok = ok && valid(ch)
+	}
+	if !ok {
+		if s.err == nil {
+			s.err = &Error{start, fmt.Sprintf("Malformed number literal '%s'", lit)}
+		}
+		return ILLEGAL, lit
+	}
+	return NUMBER, lit
+}
+
+// scanUntil reads the raw text up to end, for the <file> of an .INCLUDE. It's
+// false if the line ends first.
+func (s *Scanner) scanUntil(end rune) (string, bool) {
+	s.text = s.text[:0]
+	for {
+		ch := s.read()
+		if ch == end {
+			return string(s.text), true
+		} else if ch == '\n' || ch == eof {
+			s.unread()
+			return string(s.text), false
+		}
+		s.keep(ch)
+	}
+}
+
+// isAnonRef reports whether lit is a reference to an anonymous label: a
+// positive decimal count followed by f (forward) or b (backward).
+func isAnonRef(lit string) bool {
+	n := len(lit)
+	if n < 2 || lit[0] == '0' || !strings.ContainsRune("fFbB", rune(lit[n-1])) {
+		return false
+	}
+	for _, ch := range lit[:n-1] {
+		if !isDigit(ch) {
+			return false
 		}
 	}
+	return true
 }
 
 func isHexDigit(ch rune) bool {
@@ -312,15 +544,15 @@ func isHexDigit(ch rune) bool {
 }
 
 func (s *Scanner) scanStringLiteral() (tok Token, lit string) {
-	var buf bytes.Buffer
+	s.text = s.text[:0]
 	// TODO: Escaping.
 	for {
 		if ch := s.read(); ch == '"' {
-			return STRING, buf.String()
+			return STRING, string(s.text)
 		} else if ch == eof {
-			return ILLEGAL, buf.String()
+			return ILLEGAL, string(s.text)
 		} else {
-			_, _ = buf.WriteRune(ch)
+			s.keep(ch)
 		}
 	}
 }
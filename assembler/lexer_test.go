@@ -0,0 +1,160 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// tok is a token and its text, for comparing scanner output without
+// positions.
+type tok struct {
+	t   Token
+	lit string
+}
+
+// scanAll runs a fresh scanner over src, dropping whitespace.
+func scanAll(src string) []tok { return scanWith(src, func(*Scanner) {}) }
+
+// scanWith is scanAll with the scanner's options set by set first.
+func scanWith(src string, set func(*Scanner)) []tok {
+	s := NewScanner("test.asm", strings.NewReader(src))
+	set(s)
+	var toks []tok
+	for _, l := range s.Tokens() {
+		if l.Token != WS {
+			toks = append(toks, tok{l.Token, l.Lit})
+		}
+	}
+	return toks
+}
+
+func TestScanner(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want []tok
+	}{
+		{"identifiers", "foo _bar baz9 Loop_2",
+			[]tok{{IDENT, "foo"}, {IDENT, "_bar"}, {IDENT, "baz9"}, {IDENT, "Loop_2"}}},
+		{"registers", "r0 R7 pc SP lr r8",
+			[]tok{{REGISTER, "r0"}, {REGISTER, "R7"}, {PC, "pc"}, {SP, "SP"}, {LR, "lr"}, {IDENT, "r8"}}},
+		{"punctuation", ". # : , [ ] { } ( ) = $",
+			[]tok{{DOT, "."}, {HASH, "#"}, {COLON, ":"}, {COMMA, ","}, {LBRAC, "["}, {RBRAC, "]"},
+				{LBRACE, "{"}, {RBRACE, "}"}, {LPAREN, "("}, {RPAREN, ")"}, {EQUALS, "="}, {DOLLAR, "$"}}},
+		{"operators", "+ - * / & | ^ ~",
+			[]tok{{PLUS, "+"}, {MINUS, "-"}, {TIMES, "*"}, {DIVIDE, "/"}, {AND, "&"}, {OR, "|"}, {XOR, "^"}, {NOT, "~"}}},
+		{"shifts", "1<<2 x>>3 y>>>4",
+			[]tok{{NUMBER, "1"}, {LANGLES, "<<"}, {NUMBER, "2"}, {IDENT, "x"}, {RANGLES, ">>"}, {NUMBER, "3"},
+				{IDENT, "y"}, {ASR, ">>>"}, {NUMBER, "4"}}},
+		{"comparisons", "== != < <= > >=",
+			[]tok{{EQ, "=="}, {NE, "!="}, {LT, "<"}, {LE, "<="}, {GT, ">"}, {GE, ">="}}},
+		{"decimal", "0 42 010 65535",
+			[]tok{{NUMBER, "0"}, {NUMBER, "42"}, {NUMBER, "010"}, {NUMBER, "65535"}}},
+		{"hex and binary", "0x1f 0XBEEF 0b101",
+			[]tok{{NUMBER, "0x1f"}, {NUMBER, "0XBEEF"}, {NUMBER, "0b101"}}},
+		{"strings", `"hello, world" ""`,
+			[]tok{{STRING, "hello, world"}, {STRING, ""}}},
+		{"line comments", "add r0, r1 ; a comment, with [stuff]\nret",
+			[]tok{{IDENT, "add"}, {REGISTER, "r0"}, {COMMA, ","}, {REGISTER, "r1"}, {NEWLINE, "\n"}, {IDENT, "ret"}}},
+		{"instruction", "  ldr r0, [sp, #0x10]",
+			[]tok{{IDENT, "ldr"}, {REGISTER, "r0"}, {COMMA, ","}, {LBRAC, "["}, {SP, "sp"}, {COMMA, ","},
+				{HASH, "#"}, {NUMBER, "0x10"}, {RBRAC, "]"}}},
+		{"label and directive", ":table .dat 1, 2",
+			[]tok{{COLON, ":"}, {IDENT, "table"}, {DOT, "."}, {IDENT, "dat"}, {NUMBER, "1"}, {COMMA, ","}, {NUMBER, "2"}}},
+		{"crlf", "ret\r\nbrk",
+			[]tok{{IDENT, "ret"}, {NEWLINE, "\n"}, {IDENT, "brk"}}},
+	}
+	for _, tt := range tests {
+		got := scanAll(tt.src)
+		if !equalToks(got, tt.want) {
+			t.Errorf("%s: scanning %q\n got  %v\n want %v", tt.name, tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestScannerPositions(t *testing.T) {
+	toks := NewScanner("test.asm", strings.NewReader("add r0, #1\n  ret")).Tokens()
+	want := map[string]Position{
+		"add": {"test.asm", 1, 1},
+		"r0":  {"test.asm", 1, 5},
+		"1":   {"test.asm", 1, 10},
+		"ret": {"test.asm", 2, 3},
+	}
+	for _, l := range toks {
+		if pos, ok := want[l.Lit]; ok && l.Pos != pos {
+			t.Errorf("%q is at %v, want %v", l.Lit, l.Pos, pos)
+		}
+	}
+}
+
+func equalToks(a, b []tok) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMalformedNumbers(t *testing.T) {
+	// A number runs to the end of the word, and the whole word has to be
+	// valid; none of these split into a number and a name.
+	for _, lit := range []string{"0xG", "0x", "0x1g", "5foo", "0b", "0b102", "12_3"} {
+		toks := scanAll(lit)
+		if len(toks) != 1 || toks[0] != (tok{ILLEGAL, lit}) {
+			t.Errorf("scanning %q: got %v, want it ILLEGAL", lit, toks)
+		}
+		_, err := NewParser("test.asm", strings.NewReader(".dat "+lit+"\n")).Parse()
+		if want := "Malformed number literal '" + lit + "'"; err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf(".dat %s: got error %v, want %s", lit, err, want)
+		}
+	}
+}
+
+func TestAltComments(t *testing.T) {
+	alt := func(s *Scanner) { s.altComments = true }
+	tests := []struct {
+		src        string
+		plain, alt []tok
+	}{
+		{"ret // done",
+			[]tok{{IDENT, "ret"}, {DIVIDE, "/"}, {DIVIDE, "/"}, {IDENT, "done"}},
+			[]tok{{IDENT, "ret"}}},
+		{"8 / 2 //x",
+			[]tok{{NUMBER, "8"}, {DIVIDE, "/"}, {NUMBER, "2"}, {DIVIDE, "/"}, {DIVIDE, "/"}, {IDENT, "x"}},
+			[]tok{{NUMBER, "8"}, {DIVIDE, "/"}, {NUMBER, "2"}}},
+		// # only starts a comment in the first column; elsewhere it's a literal.
+		{"# note\n  mov r0, #1",
+			[]tok{{HASH, "#"}, {IDENT, "note"}, {NEWLINE, "\n"}, {IDENT, "mov"}, {REGISTER, "r0"}, {COMMA, ","}, {HASH, "#"}, {NUMBER, "1"}},
+			[]tok{{NEWLINE, "\n"}, {IDENT, "mov"}, {REGISTER, "r0"}, {COMMA, ","}, {HASH, "#"}, {NUMBER, "1"}}},
+	}
+	for _, tc := range tests {
+		if got := scanAll(tc.src); !equalToks(got, tc.plain) {
+			t.Errorf("scanning %q: got %v, want %v", tc.src, got, tc.plain)
+		}
+		if got := scanWith(tc.src, alt); !equalToks(got, tc.alt) {
+			t.Errorf("scanning %q with -alt-comments: got %v, want %v", tc.src, got, tc.alt)
+		}
+	}
+
+	// Without the flag, a // comment after an instruction is a parse error.
+	if _, err := NewParser("test.asm", strings.NewReader("  ret // done\n")).Parse(); err == nil {
+		t.Errorf("ret // done: parsed without -alt-comments")
+	}
+}
+
+func TestRawIdents(t *testing.T) {
+	const src = "PC r3 sp LR add r8"
+	want := []tok{{PC, "PC"}, {REGISTER, "r3"}, {SP, "sp"}, {LR, "LR"}, {IDENT, "add"}, {IDENT, "r8"}}
+	if got := scanAll(src); !equalToks(got, want) {
+		t.Errorf("scanning %q: got %v, want %v", src, got, want)
+	}
+	// With rawIdents, register names are identifiers like any other.
+	want = []tok{{IDENT, "PC"}, {IDENT, "r3"}, {IDENT, "sp"}, {IDENT, "LR"}, {IDENT, "add"}, {IDENT, "r8"}}
+	if got := scanWith(src, func(s *Scanner) { s.rawIdents = true }); !equalToks(got, want) {
+		t.Errorf("scanning %q with rawIdents: got %v, want %v", src, got, want)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+)
+
+var (
+	linkFlags = flag.NewFlagSet("link", flag.ExitOnError)
+	linkOut   = linkFlags.String("o", "out.bin", "File to write the linked binary to")
+	linkMap   = linkFlags.String("map", "out.map", "File to write the address of every exported symbol to, or empty for none")
+	linkPad   = linkFlags.String("pad", "0", "Value for gaps between segments")
+	linkDefs  = linkFlags.Bool("emit-defines", false, "Also list each object's .DEFINEs and .CONSTs in the -map file")
+)
+
+// Linking puts each object's segments at the addresses they were assembled
+// for, so modules are placed with -org or .ORG when they're assembled. Then
+// every relocation is patched with the value of the symbol some object
+// exports. Two objects writing the same address, two exporting the same name,
+// or a symbol nobody exports are all errors.
+
+// linkedSymbol is an exported symbol, and the object that exported it.
+type linkedSymbol struct {
+	value uint16
+	file  string
+}
+
+// linkedDefine is a .DEFINE or .CONST from one of the objects, for
+// -emit-defines. Unlike labels, two objects can each have their own.
+type linkedDefine struct {
+	name  string
+	value uint16
+	file  string
+}
+
+func runLink(args []string) {
+	padValue, err := parseConstant(*linkPad)
+	if err != nil {
+		fmt.Printf("Error: bad -pad: %v\n", err)
+		os.Exit(1)
+	}
+	if *linkDefs && *linkMap == "" {
+		fmt.Println("Error: -emit-defines needs a -map file to write them to")
+		os.Exit(1)
+	}
+	objs := make([]*ObjectFile, len(args))
+	for i, name := range args {
+		if objs[i], err = readObjectFile(name); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	s, symbols, errs := link(args, objs)
+	if len(errs) > 0 {
+		for _, e := range errs {
+			fmt.Printf("Error: %s\n", e)
+		}
+		os.Exit(1)
+	}
+	s.opts.PadValue = padValue
+	if err := writeOutput(*linkOut, nil, s); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if *linkMap != "" {
+		var defines []linkedDefine
+		if *linkDefs {
+			for i, obj := range objs {
+				for _, name := range sortedKeys(obj.Defines) {
+					defines = append(defines, linkedDefine{name, obj.Defines[name], args[i]})
+				}
+			}
+			sort.SliceStable(defines, func(i, j int) bool { return defines[i].name < defines[j].name })
+		}
+		if err := writeLinkMap(*linkMap, symbols, defines); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+// link combines the objects, read from the named files, into one image. It
+// returns every problem it finds, rather than stopping at the first.
+func link(names []string, objs []*ObjectFile) (*AssemblyState, map[string]linkedSymbol, []string) {
+	var errs []string
+	symbols := make(map[string]linkedSymbol)
+	for i, obj := range objs {
+		for _, name := range sortedKeys(obj.Exports) {
+			if first, ok := symbols[name]; ok {
+				errs = append(errs, fmt.Sprintf("'%s' is defined in both %s and %s", name, first.file, names[i]))
+				continue
+			}
+			symbols[name] = linkedSymbol{obj.Exports[name], names[i]}
+		}
+	}
+
+	s := &AssemblyState{rom: make([]uint16, 0x10000), used: make(map[uint16]bool)}
+	owner := make(map[uint16]int) // Which object wrote each address.
+	for i, obj := range objs {
+		overlapped := make(map[int]bool)
+		for _, seg := range obj.Segments {
+			for j, w := range seg.Words {
+				a := int(seg.Origin) + j
+				if a > 0xffff {
+					errs = append(errs, fmt.Sprintf("%s has a segment at 0x%04x that runs past the end of memory", names[i], seg.Origin))
+					break
+				}
+				if prev, ok := owner[uint16(a)]; ok {
+					if !overlapped[prev] {
+						overlapped[prev] = true
+						errs = append(errs, fmt.Sprintf("%s and %s both write to address 0x%04x", names[prev], names[i], a))
+					}
+					continue
+				}
+				owner[uint16(a)] = i
+				s.used[uint16(a)] = true
+				s.rom[a] = w
+			}
+		}
+	}
+
+	for i, obj := range objs {
+		for _, r := range obj.Relocations {
+			sym, ok := symbols[r.Symbol]
+			if !ok {
+				errs = append(errs, fmt.Sprintf("Unresolved external '%s', used at 0x%04x in %s", r.Symbol, r.Site, names[i]))
+				continue
+			}
+			value := sym.value + r.Addend
+			switch r.Kind {
+			case relocWord:
+				if owner[r.Site] != i || !s.used[r.Site] {
+					break
+				}
+				s.rom[r.Site] = value
+				continue
+			case relocMovMVH:
+				if owner[r.Site] != i || !s.used[r.Site] || owner[r.Site+1] != i || !s.used[r.Site+1] {
+					break
+				}
+				s.rom[r.Site] = s.rom[r.Site]&0xff00 | value&0xff
+				s.rom[r.Site+1] = s.rom[r.Site+1]&0xff00 | value>>8
+				continue
+			}
+			errs = append(errs, fmt.Sprintf("%s has a bad %s relocation for '%s' at 0x%04x", names[i], r.Kind, r.Symbol, r.Site))
+		}
+	}
+	return s, symbols, errs
+}
+
+// writeLinkMap writes each exported symbol's address and object file, one per
+// line, in address order. Then come the defines, in name order, each marked
+// ;define so they can't be mistaken for addresses.
+func writeLinkMap(name string, symbols map[string]linkedSymbol, defines []linkedDefine) error {
+	names := make([]string, 0, len(symbols))
+	for n := range symbols {
+		names = append(names, n)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := symbols[names[i]], symbols[names[j]]
+		if a.value != b.value {
+			return a.value < b.value
+		}
+		return names[i] < names[j]
+	})
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, n := range names {
+		fmt.Fprintf(w, "%04x %s %s\n", symbols[n].value, n, symbols[n].file)
+	}
+	for _, d := range defines {
+		fmt.Fprintf(w, "%04x %s %s ;define\n", d.value, d.name, d.file)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// sortedKeys returns the keys of m in order, so that errors come out the same
+// way every time.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
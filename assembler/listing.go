@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// writeListing runs one more pass over an already-assembled program, printing
+// each line of the source alongside its address and the words it produced.
+// The word count makes multi-word expansions (long branches, large MOVs) easy
+// to spot. source is the text of the main file; .INCLUDEd files come from the
+// AST. Mnemonics and registers in the source are recased as c says.
+func writeListing(w io.Writer, ast *AST, s *AssemblyState, source string, c textCase) {
+	srcs := map[string][]string{ast.File: strings.Split(source, "\n")}
+	for path, data := range ast.Included {
+		srcs[path] = strings.Split(string(data), "\n")
+	}
+	s.reset()
+	prev, prevFile := uint(0), ""
+	for i, l := range ast.Lines {
+		start := s.index
+		l.Assemble(s)
+
+		// Several statements can share a line, eg. a label and an instruction.
+		// Only show the text on the first of them.
+		text := ""
+		src, file := srcs[ast.SourceFiles[i]], ast.SourceFiles[i]
+		if n := ast.SourceLines[i]; (n != prev || file != prevFile) && 0 < n && int(n) <= len(src) {
+			text = strings.TrimRight(src[n-1], "\r")
+			if c != caseKeep {
+				code, comment := splitComment(text)
+				text = applyCase(code, c) + comment
+			}
+		}
+		prev, prevFile = ast.SourceLines[i], file
+
+		// .ORG moves the index rather than emitting anything.
+		if _, ok := l.(*Org); ok || s.index == start {
+			fmt.Fprintf(w, "%04x       %-24s %5d  %s\n", s.index, "", ast.SourceLines[i], text)
+			continue
+		}
+
+		if _, ok := l.(*Reserve); ok {
+			fmt.Fprintf(w, "%04x  %3d  %-24s %5d  %s\n", start, s.index-start, "(reserved)", ast.SourceLines[i], text)
+			continue
+		}
+
+		words := make([]string, 0, s.index-start)
+		for a := start; a != s.index; a++ {
+			words = append(words, fmt.Sprintf("%04x", s.rom[a]))
+		}
+		ws := strings.Join(words, " ")
+		if len(words) > 4 {
+			ws = strings.Join(words[:4], " ") + " ..."
+		}
+		if w, ok := l.(*RawWord); ok {
+			if w.opcode {
+				ws += " (opcode)"
+			} else {
+				ws += " (word)"
+			}
+		}
+		fmt.Fprintf(w, "%04x  %3d  %-24s %5d  %s\n", start, len(words), ws, ast.SourceLines[i], text)
+	}
+}
@@ -2,51 +2,730 @@ package main
 
 import (
 	"bufio"
+	"encoding/binary"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 )
 
+var (
+	assembleFlags = flag.NewFlagSet("assemble", flag.ExitOnError)
+
+	listing = assembleFlags.Bool("listing", false, "Print a listing of addresses, sizes and encoded words")
+	maxROM  = assembleFlags.Uint("max-rom", 0, "Fail if the program needs more than this many words of ROM (0 for no limit)")
+	org     = assembleFlags.String("org", "0", "Address to start assembling at, before any .ORG")
+
+	diagnosticsJSON = assembleFlags.Bool("diagnostics-json", false, "Print errors and warnings as JSON instead of assembling")
+	noOpCollapse    = assembleFlags.Bool("no-op-collapse", false, "Don't expand out-of-range MOV immediates into NEG or MOV+MVH; report an error instead")
+	warnTruncate    = assembleFlags.Bool("Wtruncate", false, "Warn about .DAT values that don't fit in 16 bits")
+	traceEncoding   = assembleFlags.Bool("trace-encoding", false, "Print which encoder handled each instruction, and the words it produced")
+	entry           = assembleFlags.String("entry", "", "Label of the program's entry point")
+	entryFormat     = assembleFlags.String("entry-format", "print", "How to record -entry: print it, or prepend it to the output as a one-word header")
+	defines         = assembleFlags.String("defines", "", "File of NAME = value lines to define before assembling")
+	stats           = assembleFlags.Bool("stats", false, "Print how many times each mnemonic is used, and how many words it takes up")
+	sizes           = assembleFlags.Bool("sizes", false, "Print how many words each label covers, up to the next label")
+	warnUnusedFlag  = assembleFlags.Bool("Wunused", false, "Warn about labels and .DEFINEs that are never used")
+	warnGap         = assembleFlags.Int("Wgap", 0, "Warn about gaps of more than this many words between written parts of out.bin (0 for none)")
+	warnRedefine    = assembleFlags.Bool("Wredefine", false, "Warn when a .DEFINE changes the value of an earlier one")
+	warnShadowFlag  = assembleFlags.Bool("Wshadow", true, "Warn about names that are both a label and a .DEFINE")
+	warnIndent      = assembleFlags.Bool("Windent", false, "Warn about lines indented with both tabs and spaces")
+	werror          = assembleFlags.Bool("Werror", false, "Treat warnings as errors")
+	reserved        rangeList
+	stringCharset   charset
+	includePaths    pathList
+	listingCase     textCase
+	pad             = assembleFlags.String("pad", "0", "Value for gaps in the output, and for .ALIGN until a .PADVALUE")
+	cacheFile       = assembleFlags.String("cache", "", "File to keep label addresses in between runs, to speed up the next one")
+	encJSON         = assembleFlags.String("encjson", "", "Write each instruction's address, operands and encoding to this file as JSON")
+	buildID         = assembleFlags.String("build-id", "0", "Value of the __BUILD_ID__ symbol")
+	compactROM      = assembleFlags.Bool("compact-rom", false, "Only allocate as much of the ROM as the program uses")
+	split           = assembleFlags.Bool("split", false, "Write each segment to its own out.0xADDR.bin, listed in out.manifest, instead of out.bin")
+	format          = assembleFlags.String("format", "bin", "Output format: bin for a binary in out.bin, or obj for an object file with external symbols in out.obj")
+	altComments     = assembleFlags.Bool("alt-comments", false, "Also treat // and a # in the first column as starting a comment")
+	identChars      = assembleFlags.String("ident-chars", "", "Also allow these characters, any of . and $, in names after the first character")
+	hexdump         = assembleFlags.Bool("hexdump", false, "Print the assembled words and labels in hex, instead of writing out.bin")
+	dumpSymbols     = assembleFlags.Bool("dump-symbols-on-error", false, "If assembly fails, print every label and define with its value, and what it was the pass before")
+	compare         = assembleFlags.String("compare", "", "Compare the program with this reference binary, and show the first word that differs, instead of writing out.bin")
+	parseOnly       = assembleFlags.Bool("parse-only", false, "Only parse the source, and print how long it took; for benchmarking the parser")
+	maxDepth        = assembleFlags.Int("max-depth", defaultMaxDepth, "Most levels of brackets an expression can nest")
+
+	// Print internal tracing to stderr, with -v on any command.
+	verbose bool
+)
+
+// A command is one of the tool's subcommands, each with its own flags.
+type command struct {
+	flags   *flag.FlagSet
+	args    string // Positional arguments, for the usage message; "" for none.
+	summary string
+	run     func(args []string)
+	// Takes one or more positional arguments, rather than exactly one.
+	variadic bool
+}
+
+var commands map[string]*command
+
+func init() {
+	assembleFlags.Var(&stringCharset, "charset", "Warn about string characters outside this set: ascii, or a comma-separated list of `LO-HI` code point ranges")
+	assembleFlags.Var(&reserved, "reserve", "Address range `LO-HI` that nothing may be written to; can be repeated")
+	assembleFlags.Var(&includePaths, "I", "Directory to look in for .INCLUDE files; can be repeated")
+	assembleFlags.Var(&listingCase, "case", "Case of mnemonics and registers in the -listing: keep, upper or lower")
+	disasmFlags.Var(&disasmCase, "case", "Case of mnemonics and registers: keep, upper or lower")
+	fmtFlags.Var(&fmtCase, "case", "Case of mnemonics and registers: keep, upper or lower")
+
+	commands = map[string]*command{
+		"assemble": {assembleFlags, "file.asm", "Assemble a source file into out.bin", runAssemble, false},
+		"disasm":   {disasmFlags, "file.bin", "Disassemble a binary", runDisasm, false},
+		"fmt":      {fmtFlags, "file.asm", "Reformat a source file", runFmt, false},
+		"dump":     {dumpFlags, "file.asm", "Print the parsed AST of a source file", runDump, false},
+		"link":     {linkFlags, "file.obj...", "Link object files from assemble -format obj into a binary", runLink, true},
+		"repl":     {replFlags, "", "Assemble instructions typed in one at a time, and show their encodings", runRepl, false},
+	}
+	for name, c := range commands {
+		name, c := name, c
+		c.flags.BoolVar(&verbose, "v", false, "Print internal tracing to stderr")
+		c.flags.Usage = func() {
+			fmt.Fprintf(c.flags.Output(), "Usage: %s %s [flags] %s\n", filepath.Base(os.Args[0]), name, c.args)
+			c.flags.PrintDefaults()
+		}
+	}
+}
+
+// pathList collects the directories given to a repeatable flag like -I.
+type pathList []string
+
+func (l *pathList) String() string { return strings.Join(*l, ",") }
+
+func (l *pathList) Set(dir string) error {
+	*l = append(*l, dir)
+	return nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags] [args]\n\nCommands:\n", filepath.Base(os.Args[0]))
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for a command's flags.\n", filepath.Base(os.Args[0]))
+}
+
 func main() {
-	// Grab the first argument and assemble it.
-	file := os.Args[1]
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	c, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	c.flags.Parse(os.Args[2:])
+	want := 1
+	if c.args == "" {
+		want = 0
+	}
+	if n := c.flags.NArg(); n != want && !(c.variadic && n > 1) {
+		c.flags.Usage()
+		os.Exit(2)
+	}
+	c.run(c.flags.Args())
+}
+
+// openSource opens and parses a source file, exiting on errors.
+func openSource(file string) *AST {
+	f, err := os.Open(file)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	ast, err := NewParser(file, bufio.NewReader(f)).Parse()
+	if err != nil {
+		reportParseError(err)
+		os.Exit(1)
+	}
+	return ast
+}
+
+func reportParseError(err error) {
+	if e, ok := err.(*Error); ok {
+		fmt.Printf("Error: Parse error at %s   %s\n", e.Pos, e.Msg)
+		showSource(os.Stdout, e.Pos, colorRed)
+	} else {
+		fmt.Printf("Error: %v\n", err)
+	}
+}
+
+func runAssemble(args []string) {
+	origin, err := parseConstant(*org)
+	if err != nil {
+		fmt.Printf("Error: bad -org: %v\n", err)
+		os.Exit(1)
+	}
+	padValue, err := parseConstant(*pad)
+	if err != nil {
+		fmt.Printf("Error: bad -pad: %v\n", err)
+		os.Exit(1)
+	}
+	id, err := parseConstant(*buildID)
+	if err != nil {
+		fmt.Printf("Error: bad -build-id: %v\n", err)
+		os.Exit(1)
+	}
+	opts := Options{
+		Origin:        origin,
+		NoOpCollapse:  *noOpCollapse,
+		WarnTruncate:  *warnTruncate,
+		TraceEncoding: *traceEncoding,
+		WarnUnused:    *warnUnusedFlag,
+		WarnShadow:    *warnShadowFlag,
+		WarnRedefine:  *warnRedefine,
+		WarnIndent:    *warnIndent,
+		WarnGap:       *warnGap,
+		Entry:         *entry,
+		Reserved:      reserved,
+		Charset:       stringCharset,
+		PadValue:      padValue,
+	}
+	opts.RecordEncodings = *encJSON != ""
+	opts.CompactROM = *compactROM
+	opts.KeepPrevious = *dumpSymbols
+	opts.BuildID = id
+	switch *format {
+	case "bin":
+	case "obj":
+		if *split || *compare != "" {
+			fmt.Println("Error: -split and -compare only apply to -format bin")
+			os.Exit(1)
+		}
+		opts.Externals = true
+	default:
+		fmt.Printf("Error: unknown -format '%s'; expected bin or obj\n", *format)
+		os.Exit(1)
+	}
+	if strings.Trim(*identChars, ".$") != "" {
+		fmt.Println("Error: -ident-chars can only contain . and $")
+		os.Exit(1)
+	}
+	if *maxDepth < 0 {
+		fmt.Printf("Error: -max-depth can't be negative, but is %d\n", *maxDepth)
+		os.Exit(1)
+	}
+	if *defines != "" {
+		opts.Defines, err = readDefines(*defines)
+		if err != nil {
+			fmt.Printf("Error: bad -defines file: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	file := args[0]
 	f, err := os.Open(file)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
 	p := NewParser(file, bufio.NewReader(f))
+	p.s.altComments = *altComments
+	p.s.identChars = *identChars
+	p.maxDepth = *maxDepth
+	p.includePaths = includePaths
+	p.predefine(opts.Defines)
+	parseStart := time.Now()
 	ast, err := p.Parse()
+	if *parseOnly {
+		if err != nil {
+			reportParseError(err)
+			os.Exit(1)
+		}
+		fmt.Printf("Parsed %d lines in %v\n", len(ast.Lines), time.Since(parseStart))
+		return
+	}
+	if *diagnosticsJSON {
+		// Diagnostics were produced successfully even if there are errors, so
+		// this exits with 0 either way.
+		var warnings ErrorList
+		if err == nil {
+			var s *AssemblyState
+			opts.KeepGoing = true
+			s, err = assemble(ast, opts)
+			warnings = s.warnings
+		}
+		if err := writeDiagnostics(os.Stdout, err, warnings); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	if err != nil {
-		fmt.Printf("Error: %v\n", err)
+		reportParseError(err)
+		os.Exit(1)
+	}
+
+	var key string
+	if *cacheFile != "" {
+		source, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		key = cacheKey(source, ast, opts, p.s)
+		opts.Cache = readCache(*cacheFile, key)
+	}
+
+	s, err := assemble(ast, opts)
+	for _, w := range s.warnings {
+		fmt.Printf("Warning at %s %s\n", w.Pos, w.Msg)
+		showSource(os.Stdout, w.Pos, colorYellow)
+	}
+	for _, t := range s.traces {
+		fmt.Println(t)
+	}
+	if err != nil {
+		reportAssemblyErrors(err)
+		if *dumpSymbols {
+			writeSymbolDump(os.Stdout, s)
+		}
+		os.Exit(1)
+	}
+	if *werror && len(s.warnings) > 0 {
+		fmt.Printf("Error: %d warnings, and -Werror is set\n", len(s.warnings))
+		os.Exit(1)
+	}
+
+	if size := s.size(); *maxROM != 0 && uint(size) > *maxROM {
+		fmt.Printf("Error: program is %d words, exceeds max %d words\n", size, *maxROM)
+		os.Exit(1)
+	}
+
+	var header []uint16
+	if *entry != "" {
+		lr, ok := s.labels[*entry]
+		if !ok {
+			fmt.Printf("Error: entry label '%s' is not defined\n", *entry)
+			os.Exit(1)
+		}
+		switch *entryFormat {
+		case "print":
+			fmt.Printf("Entry point: %s = 0x%04x\n", *entry, lr.value)
+		case "header":
+			if opts.Externals || *split {
+				fmt.Println("Error: -entry-format header only applies to -format bin without -split")
+				os.Exit(1)
+			}
+			header = append(header, lr.value)
+		default:
+			fmt.Printf("Error: unknown -entry-format '%s'; expected print or header\n", *entryFormat)
+			os.Exit(1)
+		}
+	}
+
+	if *listing {
+		source, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		writeListing(os.Stdout, ast, s, string(source), listingCase)
+	}
+	if *stats {
+		writeStats(os.Stdout, ast, s)
+	}
+	if *sizes {
+		writeSizes(os.Stdout, s)
+	}
+	if *hexdump {
+		// A quick look at the result; there's no binary written.
+		writeHexdump(os.Stdout, s)
+		return
+	}
+	if *compare != "" {
+		ref, err := readWords(*compare)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if !writeComparison(os.Stdout, ast, s, ref, *compare) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if opts.Externals {
+		if err := writeObjectFile("out.obj", s); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	} else if *split {
+		if err := writeSplit("out", s); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
 	} else {
-		s := new(AssemblyState)
-		s.labels = make(map[string]*LabelRef)
+		// Now output the binary. It's always big-endian; .ENDIAN only changes
+		// how data is packed into words.
+		// TODO: A flag for the output filename; out.bin, out.obj and the -split
+		// files are all fixed names.
+		if err := writeOutput("out.bin", header, s); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *encJSON != "" {
+		if err := writeEncodingFile(*encJSON, s); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if *cacheFile != "" {
+		if err := writeCache(*cacheFile, key, s); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+}
+
+func reportAssemblyErrors(err error) {
+	switch e := err.(type) {
+	case *Error:
+		fmt.Printf("Assembly error at %s %s\n", e.Pos, e.Msg)
+		showSource(os.Stdout, e.Pos, colorRed)
+	case ErrorList:
+		for _, x := range e {
+			reportAssemblyErrors(x)
+		}
+	default:
+		fmt.Printf("Error: %v\n", err)
+	}
+}
+
+// writeOutput writes the assembled binary, preceded by any header words, to a
+// temporary file next to name, and only renames it into place once it's
+// completely written. A failed run leaves any previous output untouched.
+func writeOutput(name string, header []uint16, s *AssemblyState) error {
+	out, err := os.CreateTemp(filepath.Dir(name), "."+filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name()) // Fails harmlessly after the rename.
+
+	if _, err := out.Write(outputBytes(header, s, binary.BigEndian)); err != nil {
+		out.Close()
+		return err
+	}
+	// CreateTemp makes the file private; give it the usual permissions.
+	if err := out.Chmod(0644); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), name)
+}
+
+// outputBytes encodes the header words and then the assembled program in the
+// given byte order. That's up to the last word written; anything .RESERVEd
+// after that is left off. Gaps before it are filled with Options.PadValue.
+func outputBytes(header []uint16, s *AssemblyState, order binary.ByteOrder) []byte {
+	words := imageWords(s)
+	buf := make([]byte, 2*(len(header)+len(words)))
+	for i, h := range header {
+		order.PutUint16(buf[2*i:], h)
+	}
+	out := buf[2*len(header):]
+	for i, word := range words {
+		order.PutUint16(out[2*i:], word)
+	}
+	return buf
+}
+
+// imageWords returns the assembled program as it goes in the binary, from 0
+// up to the last word written, with the gaps filled with Options.PadValue.
+func imageWords(s *AssemblyState) []uint16 {
+	words := make([]uint16, s.size())
+	for i := range words {
+		words[i] = s.rom[i]
+		if !s.used[uint16(i)] {
+			words[i] = s.opts.PadValue
+		}
+	}
+	return words
+}
+
+// AssembleBytes assembles the source read from r, and returns the binary in
+// the given byte order, along with any warnings. filename is only used in
+// error messages. Nothing touches the filesystem unless the source uses
+// .INCBIN or .INCLUDE, so it suits a playground or a server as well as the
+// command line.
+//
+// Parse errors are returned as an *Error, and assembly errors as an *Error or
+// an ErrorList (with Options.KeepGoing), as from assemble.
+func AssembleBytes(filename string, r io.Reader, opts Options, order binary.ByteOrder) ([]byte, ErrorList, error) {
+	p := NewParser(filename, r)
+	p.predefine(opts.Defines)
+	ast, err := p.Parse()
+	if err != nil {
+		return nil, nil, err
+	}
+	s, err := assemble(ast, opts)
+	if err != nil {
+		return nil, s.warnings, err
+	}
+	return outputBytes(nil, s, order), s.warnings, nil
+}
+
+// maxPasses bounds the number of assembly passes.
+const maxPasses = 100
+
+// assemble runs the passes over the AST until every label has settled, and
+// returns the final state. On errors, the state is still returned, as far as it
+// got. With Options.KeepGoing, that's the whole program less the lines with
+// errors, and the error is an ErrorList of all of them.
+func assemble(ast *AST, opts Options) (s *AssemblyState, err error) {
+	// Assembly errors are raised as *Error panics; turn them back into an
+	// ordinary error.
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			err = e
+		}
+	}()
+
+	s = new(AssemblyState)
+	s.labels = make(map[string]*LabelRef)
+	s.externals = make(map[string]bool)
+	s.opts = opts
+	s.reset()
+	// Collect the labels. Each can only be defined once; otherwise the passes
+	// would never settle on its address.
+	debugf("===========================\n")
+	defs := make(map[string]*LabelDef)
+	var dups ErrorList
+	for _, l := range ast.Lines {
+		debugf("line: %#v\n", l)
+		labelDef, ok := l.(*LabelDef)
+		if ok {
+			if first, ok := defs[labelDef.label]; ok {
+				dups = append(dups, &Error{labelDef.loc, fmt.Sprintf("Label '%s' is already defined at %s", labelDef.label, first.loc)})
+				continue
+			}
+			defs[labelDef.label] = labelDef
+			debugf("label added: %s\n", labelDef.label)
+			s.addLabel(labelDef.label)
+		}
+	}
+	if opts.Cache != nil {
+		for name, value := range opts.Cache.labels {
+			if lr, ok := s.labels[name]; ok {
+				lr.value = value
+				lr.defined = true
+			}
+		}
+		for name, value := range opts.Cache.defines {
+			s.symbols[name] = &LabelRef{value, false}
+		}
+	}
+	if opts.WarnShadow {
+		warnShadowed(ast, s, defs)
+	}
+	if opts.WarnIndent {
+		for _, pos := range ast.MixedIndent {
+			s.warn(pos, "Indentation mixes tabs and spaces")
+		}
+	}
+	if len(opts.Charset) > 0 {
+		checkCharset(ast, s)
+	}
+	var errs ErrorList
+	if len(dups) > 0 {
+		if !opts.KeepGoing {
+			return s, dups
+		}
+		errs = append(errs, dups...)
+	}
+	if err := checkUndefined(ast, s); err != nil {
+		if !opts.KeepGoing {
+			return s, err
+		}
+		errs = append(errs, err.(ErrorList)...)
+	}
+	s.variables = make(map[string]bool)
+	for _, l := range ast.Lines {
+		if d, ok := l.(*SymbolDef); ok && d.variable {
+			s.variables[d.name] = true
+		}
+	}
+	if err := checkConsts(ast); err != nil {
+		if !opts.KeepGoing {
+			return s, err
+		}
+		errs = append(errs, err.(ErrorList)...)
+	}
+
+	// Now actually assemble everything. Each pass reuses the same state, and we
+	// stop as soon as a pass leaves every label where it found it. An empty
+	// program (or one with only comments and .DEFINEs) settles after one pass.
+	// Labels only move when the code before them changes size, so a program
+	// that's still moving after maxPasses never will.
+	s.dirty = true
+	for pass := 0; s.dirty || !s.resolved; pass++ {
+		if pass == maxPasses {
+			return s, fmt.Errorf("label addresses didn't settle after %d passes", maxPasses)
+		}
+		s.pass = pass + 1
+		if opts.KeepPrevious {
+			s.prevLabels = symbolValues(s.labels)
+			s.prevSymbols = symbolValues(s.symbols)
+		}
 		s.reset()
-		// Collect the labels.
-		fmt.Printf("===========================\n")
-		for _, l := range ast.Lines {
-			fmt.Printf("line: %#v\n", l)
-			labelDef, ok := l.(*LabelDef)
-			if ok {
-				fmt.Printf("label added: %s\n", labelDef.label)
-				s.addLabel(labelDef.label)
-			}
-		}
-
-		// Now actually assemble everything.
-		s.dirty = true
-		for s.dirty || !s.resolved {
-			s.reset()
-			for _, l := range ast.Lines {
+		s.errors = s.errors[:0]
+		for i, l := range ast.Lines {
+			start := s.index
+			s.line = Position{ast.SourceFiles[i], int(ast.SourceLines[i]), 1}
+			s.externalUses = s.externalUses[:0]
+			if opts.KeepGoing {
+				assembleLine(l, s)
+			} else {
 				l.Assemble(s)
 			}
-			fmt.Printf("resolved %t dirty %t\n", s.resolved, s.dirty)
+			if len(s.externalUses) > 0 {
+				// Nothing claimed it, so there's no way to record a relocation.
+				u := s.externalUses[0]
+				e := &Error{u.loc, fmt.Sprintf("External symbol '%s' can only be used in .DAT, .WORD or .OPCODE values, MOV immediates and branches", u.label)}
+				if !opts.KeepGoing {
+					return s, e
+				}
+				s.errors = append(s.errors, e)
+			}
+			if len(opts.Reserved) > 0 {
+				checkReserved(s, l, start, s.line)
+			}
+		}
+		// Defines used before their .DEFINE got last pass's value. Go again if
+		// that turned out to be wrong.
+		for name, value := range s.early {
+			if lr, ok := s.symbols[name]; ok && lr.value != value {
+				s.dirty = true
+			}
+		}
+		debugf("resolved %t dirty %t\n", s.resolved, s.dirty)
+	}
+	if opts.WarnUnused {
+		warnUnused(ast, s)
+	}
+	if opts.WarnGap > 0 && !opts.Externals {
+		warnGaps(s)
+	}
+	errs = append(errs, s.errors...)
+	errs = append(errs, s.failedAsserts...)
+	errs = append(errs, s.reservedWrites...)
+	if len(errs) > 0 {
+		return s, errs
+	}
+	return s, nil
+}
+
+// warnUnused warns about each label and .DEFINE that was never referenced.
+// Anonymous labels are left alone, since there's no name to remove, as is the
+// entry point.
+func warnUnused(ast *AST, s *AssemblyState) {
+	seen := make(map[string]bool)
+	for _, l := range ast.Lines {
+		var name, kind string
+		var loc Position
+		switch d := l.(type) {
+		case *LabelDef:
+			name, kind, loc = d.label, "Label", d.loc
+		case *SymbolDef:
+			name, kind, loc = d.name, "Define", d.loc
+		default:
+			continue
+		}
+		if seen[name] || s.referenced[name] || name == s.opts.Entry || strings.HasPrefix(name, "@") {
+			continue
+		}
+		seen[name] = true
+		s.warn(loc, "%s '%s' is never used", kind, name)
+	}
+}
+
+// warnGaps warns about each gap of more than Options.WarnGap words between
+// written words, which the binary pads out. Object files only hold the
+// written segments, so they don't need it. The warning goes on the last .ORG
+// or .RESERVE that moved to the end of the gap.
+func warnGaps(s *AssemblyState) {
+	last := -1 // The last word written before the gap.
+	for a, size := 0, s.size(); a < size; a++ {
+		if !s.used[uint16(a)] {
+			continue
+		}
+		if gap := a - last - 1; last >= 0 && gap > s.opts.WarnGap {
+			for i := len(s.jumps) - 1; i >= 0; i-- {
+				if j := s.jumps[i]; int(j.to) == a {
+					s.warn(j.loc, "Leaves a gap of %d words (0x%04x-0x%04x) that's padded out in the binary; is the address right?", gap, last+1, a-1)
+					break
+				}
+			}
 		}
+		last = a
+	}
+}
 
-		// Now output the binary, big-endian.
-		// TODO: Flexible endianness.
-		// TODO: Output filename.
-		// TODO: Include support.
-		out, _ := os.Create("out.bin")
-		defer out.Close()
-		for i := uint16(0); i < s.index; i++ {
-			out.Write([]byte{byte(s.rom[i] >> 8), byte(s.rom[i] & 0xff)})
+// warnShadowed warns about each .DEFINE or -defines name that's also a label.
+// Lookups try labels first, so the define would never be used.
+func warnShadowed(ast *AST, s *AssemblyState, labels map[string]*LabelDef) {
+	for _, l := range ast.Lines {
+		if d, ok := l.(*SymbolDef); ok {
+			if label, ok := labels[d.name]; ok {
+				s.warn(d.loc, "'%s' is also a label, defined at %s; the label takes precedence, so this .DEFINE is never used", d.name, label.loc)
+			}
+		}
+	}
+	if label, ok := labels[buildIDSymbol]; ok {
+		s.warn(label.loc, "Label '%s' hides the predefined symbol of the same name", buildIDSymbol)
+	}
+	for _, name := range sortedKeys(s.opts.Defines) {
+		if label, ok := labels[name]; ok {
+			s.warn(label.loc, "Label '%s' hides the -defines value of the same name, which is never used", name)
 		}
 	}
 }
+
+// assembleLine assembles l, recording any error in s.errors rather than
+// stopping, for Options.KeepGoing.
+func assembleLine(l Assembled, s *AssemblyState) {
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			s.errors = append(s.errors, e)
+		}
+	}()
+	l.Assemble(s)
+}
+
+// debugf prints internal tracing, with -v. It goes to stderr, keeping stdout
+// for real output. In hot paths, check verbose before calling it, so the
+// arguments aren't even boxed.
+func debugf(format string, args ...interface{}) {
+	if verbose {
+		fmt.Fprintf(os.Stderr, format, args...)
+	}
+}
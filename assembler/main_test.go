@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// The assembler binary, for tests of the command line. It's built the first
+// time one needs it, and removed by TestMain.
+var (
+	asmOnce sync.Once
+	asmDir  string
+	asmBin  string
+	asmErr  error
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if asmDir != "" {
+		os.RemoveAll(asmDir)
+	}
+	os.Exit(code)
+}
+
+// runAssembler runs the assembler with args in dir, and returns what it
+// printed, and an error if it failed.
+func runAssembler(t *testing.T, dir string, args ...string) (string, error) {
+	t.Helper()
+	asmOnce.Do(func() {
+		if asmDir, asmErr = os.MkdirTemp("", "asmtest"); asmErr != nil {
+			return
+		}
+		asmBin = filepath.Join(asmDir, "assembler")
+		if out, err := exec.Command("go", "build", "-o", asmBin, ".").CombinedOutput(); err != nil {
+			asmErr = fmt.Errorf("%v: %s", err, out)
+		}
+	})
+	if asmErr != nil {
+		t.Fatalf("building the assembler: %v", asmErr)
+	}
+	cmd := exec.Command(asmBin, args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	return string(out), err
+}
+
+// bigProgram generates n copies of a loop body, like samples/bench.sh. The
+// forward branches and references mean it takes more than one pass to settle.
+func bigProgram(n int) string {
+	var b strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, ":loop%d   ; iteration %d\n", i, i)
+		fmt.Fprintf(&b, "  mov r%d, #0x%x\n", i%8, i%256)
+		fmt.Fprintf(&b, "  add r1, r2, r3\n")
+		fmt.Fprintf(&b, "  ldr r0, [r1, #%d]\n", i%16)
+		fmt.Fprintf(&b, "  str r0, [sp, #%d + 1]\n", i%100)
+		fmt.Fprintf(&b, "  cmp r0, #%d\n", i%200)
+		fmt.Fprintf(&b, "  bne loop%d\n", (i+1)%n)
+		fmt.Fprintf(&b, "  mov r4, #done\n")
+		fmt.Fprintf(&b, "  .dat 0x1234, %d, loop%d + 1\n", i, i)
+	}
+	b.WriteString(":done\n  brk\n")
+	return b.String()
+}
+
+// BenchmarkAssemble measures the passes over an already-parsed program, where
+// reusing the state's maps from one pass to the next saves allocations.
+func BenchmarkAssemble(b *testing.B) {
+	ast, err := NewParser("big.asm", strings.NewReader(bigProgram(5000))).Parse()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := assemble(ast, Options{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestAssembleBytes(t *testing.T) {
+	const src = "  mov r0, #5\n  .dat 0x1234\n"
+	for _, tc := range []struct {
+		order binary.ByteOrder
+		want  []byte
+	}{
+		{binary.BigEndian, []byte{0x08, 0x05, 0x12, 0x34}},
+		{binary.LittleEndian, []byte{0x05, 0x08, 0x34, 0x12}},
+	} {
+		got, warnings, err := AssembleBytes("test.asm", strings.NewReader(src), Options{}, tc.order)
+		if err != nil || len(warnings) > 0 {
+			t.Errorf("%v: got error %v, warnings %v", tc.order, err, warnings)
+		} else if !bytes.Equal(got, tc.want) {
+			t.Errorf("%v: got % x, want % x", tc.order, got, tc.want)
+		}
+	}
+
+	_, _, err := AssembleBytes("test.asm", strings.NewReader("  b nowhere\n"), Options{}, binary.BigEndian)
+	if want := "test.asm:1:5 Undefined label 'nowhere'"; err == nil || err.Error() != want {
+		t.Errorf("undefined label: got error %v, want %s", err, want)
+	}
+}
+
+func TestAssembleNothing(t *testing.T) {
+	// Nothing to emit is a program like any other, and writes nothing.
+	for _, src := range []string{
+		"",
+		"\n\n",
+		"; Only comments.\n\n   ; And blank lines.\n",
+		".define x, 3\n.const y, x + 1\n.set z, 0 ; No code.",
+	} {
+		got, warnings, err := AssembleBytes("test.asm", strings.NewReader(src), Options{}, binary.BigEndian)
+		if err != nil || len(warnings) > 0 || len(got) != 0 {
+			t.Errorf("%q: got % x, warnings %v, error %v; want nothing", src, got, warnings, err)
+		}
+	}
+}
+
+func TestConstantFlags(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, text string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("prog.asm", ".dat 1\n")
+	write("ok.txt", "X = 0xffff\n")
+	write("big.txt", "X = 70000\n")
+
+	// Each of these is cut down to 16 bits if it isn't checked.
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-org", "0x10000"}, "bad -org: Value 65536 (0x10000) doesn't fit in 16 bits"},
+		{[]string{"-pad", "0x12345"}, "bad -pad: Value 74565 (0x12345) doesn't fit in 16 bits"},
+		{[]string{"-defines", "big.txt"}, "Bad value for X: Value 70000 (0x11170) doesn't fit in 16 bits"},
+	}
+	for _, tc := range tests {
+		args := append(append([]string{"assemble"}, tc.args...), "prog.asm")
+		out, err := runAssembler(t, dir, args...)
+		if err == nil || !strings.Contains(out, tc.want) {
+			t.Errorf("%s: got %v, output %q; want %s", strings.Join(tc.args, " "), err, out, tc.want)
+		}
+	}
+
+	// The largest values are fine.
+	if out, err := runAssembler(t, dir, "assemble", "-org", "0xffff", "-pad", "0xffff", "-defines", "ok.txt", "prog.asm"); err != nil {
+		t.Errorf("-org 0xffff -pad 0xffff: got %v, output %q", err, out)
+	}
+}
+
+func TestLinkEmitDefines(t *testing.T) {
+	dir := t.TempDir()
+	objects := map[string]string{
+		"a": ".define SIZE, 0x20\n.const COUNT, 3\n:start\n  bl helper\n  brk\n",
+		"b": ".org 0x100\n.define SIZE, 8\n.define LIMIT, SIZE * 2\n.set n, 1\n:helper\n  ret\n",
+	}
+	for _, name := range []string{"a", "b"} {
+		if err := os.WriteFile(filepath.Join(dir, name+".asm"), []byte(objects[name]), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if out, err := runAssembler(t, dir, "assemble", "-format", "obj", name+".asm"); err != nil {
+			t.Fatalf("assembling %s.asm: %v\n%s", name, err, out)
+		}
+		if err := os.Rename(filepath.Join(dir, "out.obj"), filepath.Join(dir, name+".obj")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if out, err := runAssembler(t, dir, "link", "-emit-defines", "a.obj", "b.obj"); err != nil {
+		t.Fatalf("linking: %v\n%s", err, out)
+	}
+
+	// The labels by address, then each object's defines by name; both
+	// objects have their own SIZE. The .SET variable isn't there.
+	got, err := os.ReadFile(filepath.Join(dir, "out.map"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `0000 start a.obj
+0100 helper b.obj
+0003 COUNT a.obj ;define
+0010 LIMIT b.obj ;define
+0020 SIZE a.obj ;define
+0008 SIZE b.obj ;define
+`
+	if string(got) != want {
+		t.Errorf("got map:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestReproducible(t *testing.T) {
+	// Labels sharing addresses, defines and anonymous labels all live in maps,
+	// whose order changes from run to run; none of it may show in the outputs.
+	src := bigProgram(50) + ":a :b :c\n.define Z, 1\n.define Y, 2\n:\n  b 1b\n"
+	runs := []struct {
+		name string
+		args []string
+		file string // The output to compare; empty for what's printed.
+	}{
+		{"listing", []string{"assemble", "-listing", "prog.asm"}, ""},
+		{"sizes", []string{"assemble", "-sizes", "prog.asm"}, ""},
+		{"encjson", []string{"assemble", "-encjson", "enc.json", "prog.asm"}, "enc.json"},
+		{"object", []string{"assemble", "-format", "obj", "prog.asm"}, "out.obj"},
+		{"link map", []string{"link", "-emit-defines", "out.obj"}, "out.map"},
+	}
+	var first []string
+	for i := 0; i < 2; i++ {
+		dir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(dir, "prog.asm"), []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		for j, r := range runs {
+			out, err := runAssembler(t, dir, r.args...)
+			if err != nil {
+				t.Fatalf("%s: %v\n%s", r.name, err, out)
+			}
+			if r.file != "" {
+				b, err := os.ReadFile(filepath.Join(dir, r.file))
+				if err != nil {
+					t.Fatal(err)
+				}
+				out = string(b)
+			}
+			if i == 0 {
+				first = append(first, out)
+			} else if out != first[j] {
+				t.Errorf("%s differs between runs:\n%s\nand:\n%s", r.name, first[j], out)
+			}
+		}
+	}
+}
+
+// TestSamples checks the golden samples as samples/check.sh does, so that
+// go test covers them too; see samples/README.md.
+func TestSamples(t *testing.T) {
+	dir, err := filepath.Abs("../samples")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// header returns the text after prefix on line n of src, and whether
+	// that line starts with prefix.
+	header := func(src []byte, n int, prefix string) (string, bool) {
+		lines := strings.SplitN(string(src), "\n", n+1)
+		if len(lines) < n {
+			return "", false
+		}
+		line := strings.TrimRight(lines[n-1], "\r")
+		return strings.TrimPrefix(line, prefix), strings.HasPrefix(line, prefix)
+	}
+
+	srcs, _ := filepath.Glob(filepath.Join(dir, "*.asm"))
+	for _, path := range srcs {
+		name := strings.TrimSuffix(filepath.Base(path), ".asm")
+		t.Run(name, func(t *testing.T) {
+			src, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A first line "; flags: FLAGS" passes FLAGS, and every file
+			// written is compared with the golden copies in name.out.
+			var flags []string
+			if f, ok := header(src, 1, "; flags: "); ok {
+				flags = strings.Fields(f)
+			}
+			run := t.TempDir()
+			if out, err := runAssembler(t, run, append(append([]string{"assemble"}, flags...), path)...); err != nil {
+				t.Fatalf("didn't assemble: %v\n%s", err, out)
+			}
+			if flags == nil {
+				compareFiles(t, filepath.Join(run, "out.bin"), filepath.Join(dir, name+".bin"))
+				return
+			}
+			golden := filepath.Join(dir, name+".out")
+			got, _ := os.ReadDir(run)
+			want, _ := os.ReadDir(golden)
+			if len(got) != len(want) {
+				t.Errorf("wrote %d files, but %s has %d", len(got), golden, len(want))
+			}
+			for _, e := range want {
+				compareFiles(t, filepath.Join(run, e.Name()), filepath.Join(golden, e.Name()))
+			}
+		})
+	}
+
+	// Each of errors/*.asm must fail with an error containing the text on its
+	// first line, "; error: TEXT". A second line "; flags: FLAGS" passes FLAGS.
+	errs, _ := filepath.Glob(filepath.Join(dir, "errors", "*.asm"))
+	for _, path := range errs {
+		name := "errors/" + strings.TrimSuffix(filepath.Base(path), ".asm")
+		t.Run(name, func(t *testing.T) {
+			src, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, ok := header(src, 1, "; error: ")
+			if !ok || want == "" {
+				t.Fatalf("first line isn't '; error: TEXT'")
+			}
+			var flags []string
+			if f, ok := header(src, 2, "; flags: "); ok {
+				flags = strings.Fields(f)
+			}
+			out, err := runAssembler(t, t.TempDir(), append(append([]string{"assemble"}, flags...), path)...)
+			if err == nil {
+				t.Errorf("assembled, but should have failed")
+			} else if !strings.Contains(out, want) {
+				t.Errorf("error doesn't mention %q:\n%s", want, out)
+			}
+		})
+	}
+}
+
+// compareFiles fails t unless the files at got and want are the same.
+func compareFiles(t *testing.T, got, want string) {
+	t.Helper()
+	g, err := os.ReadFile(got)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	w, err := os.ReadFile(want)
+	if err != nil {
+		t.Errorf("%v", err)
+		return
+	}
+	if !bytes.Equal(g, w) {
+		t.Errorf("%s differs from %s", filepath.Base(got), want)
+	}
+}
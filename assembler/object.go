@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// With -format obj, names that aren't defined anywhere in the program are
+// external symbols, left for a linker to fill in. The program is still
+// assembled at its origin, so only the externals need patching.
+//
+// An external can only go where its whole 16-bit value fits: a .DAT, .WORD or
+// .OPCODE value, a MOV immediate (always encoded as MOV+MVH), or a branch
+// target (always the long form). It can have a constant added or subtracted,
+// but nothing else, since the object only records symbol + addend.
+//
+// The object file is JSON:
+//
+//	{
+//	  "format": "risque16-object",
+//	  "version": 1,
+//	  "segments": [{"origin": 0, "words": [2048, ...]}, ...],
+//	  "exports": {"main": 0, ...},
+//	  "relocations": [{"site": 4, "symbol": "print", "kind": "word", "addend": 0}, ...]
+//	}
+//
+// segments are the runs of words written, in address order. exports are the
+// labels the program defines, except anonymous ones. Each relocation says to
+// patch the word at site with the symbol's value plus addend: for a "word",
+// the whole word; for a "movmvh", the low byte into the low 8 bits of the MOV
+// at site and the high byte into the low 8 bits of the MVH after it. The
+// words at relocation sites hold what they'd be if the symbol were 0.
+
+const (
+	objectFormat  = "risque16-object"
+	objectVersion = 1
+)
+
+// Relocation kinds: how the symbol's value is encoded at the site.
+const (
+	relocWord   = "word"
+	relocMovMVH = "movmvh"
+)
+
+// A Relocation is a use of an external symbol, to be patched by a linker.
+type Relocation struct {
+	Site   uint16 `json:"site"`
+	Symbol string `json:"symbol"`
+	Kind   string `json:"kind"`
+	Addend uint16 `json:"addend"`
+}
+
+// A Segment is a run of consecutive words at origin.
+type Segment struct {
+	Origin uint16   `json:"origin"`
+	Words  []uint16 `json:"words"`
+}
+
+// ObjectFile is the contents of a -format obj file.
+type ObjectFile struct {
+	Format      string            `json:"format"`
+	Version     int               `json:"version"`
+	Segments    []Segment         `json:"segments"`
+	Exports     map[string]uint16 `json:"exports"`
+	Relocations []Relocation      `json:"relocations"`
+	// The final value of each .DEFINE and .CONST, for link -emit-defines.
+	// Files from before there were any have none.
+	Defines map[string]uint16 `json:"defines"`
+}
+
+// externalProbe is a value for externals that's unlikely to cancel out, for
+// checking that an expression only adds a constant to one.
+const externalProbe = 0x1235
+
+// externalRef reports whether expr uses an external symbol. If it does, it
+// returns the symbol and the constant added to it, and claims the use so the
+// line isn't rejected for it.
+func externalRef(s *AssemblyState, expr Expression) (string, uint16, bool) {
+	if len(s.externals) == 0 {
+		return "", 0, false
+	}
+	before := len(s.externalUses)
+	addend := expr.Evaluate(s)
+	if len(s.externalUses) == before {
+		return "", 0, false
+	}
+	u := s.externalUses[before]
+
+	// symbol + addend moves exactly in step with the symbol. Anything else,
+	// like symbol * 2 or two symbols, doesn't.
+	s.externalValue = externalProbe
+	moved := expr.Evaluate(s)
+	s.externalValue = 0
+	s.externalUses = s.externalUses[:before]
+	if moved-addend != externalProbe {
+		asmError(u.loc, "External symbol '%s' can only have a constant added or subtracted", u.label)
+	}
+	return u.label, addend, true
+}
+
+// relocate records a relocation at the current index.
+func (s *AssemblyState) relocate(symbol, kind string, addend uint16) {
+	s.relocations = append(s.relocations, Relocation{s.index, symbol, kind, addend})
+}
+
+// segments returns the words written, as runs at consecutive addresses, in
+// address order.
+func segments(s *AssemblyState) []Segment {
+	var segs []Segment
+	for a, size := 0, s.size(); a < size; a++ {
+		if !s.used[uint16(a)] {
+			continue
+		}
+		if n := len(segs); n > 0 && int(segs[n-1].Origin)+len(segs[n-1].Words) == a {
+			segs[n-1].Words = append(segs[n-1].Words, s.rom[a])
+		} else {
+			segs = append(segs, Segment{uint16(a), []uint16{s.rom[a]}})
+		}
+	}
+	return segs
+}
+
+// buildObject collects the assembled program into an ObjectFile.
+func buildObject(s *AssemblyState) *ObjectFile {
+	obj := &ObjectFile{
+		Format:      objectFormat,
+		Version:     objectVersion,
+		Segments:    []Segment{},
+		Exports:     make(map[string]uint16),
+		Relocations: append([]Relocation{}, s.relocations...),
+		Defines:     make(map[string]uint16),
+	}
+	obj.Segments = append(obj.Segments, segments(s)...)
+	for name, lr := range s.labels {
+		if !strings.HasPrefix(name, "@") {
+			obj.Exports[name] = lr.value
+		}
+	}
+	// The symbols are as the final pass left them. A .SET variable only has
+	// a value at a particular line, so it's left out, as is __BUILD_ID__,
+	// which every object has.
+	for name, lr := range s.symbols {
+		if lr.defined && !s.variables[name] && name != buildIDSymbol {
+			obj.Defines[name] = lr.value
+		}
+	}
+	sort.Slice(obj.Relocations, func(i, j int) bool { return obj.Relocations[i].Site < obj.Relocations[j].Site })
+	return obj
+}
+
+// writeObjectFile writes the -format obj file.
+func writeObjectFile(name string, s *AssemblyState) error {
+	data, err := json.MarshalIndent(buildObject(s), "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(data, '\n'), 0644)
+}
+
+// readObjectFile reads an object file written by writeObjectFile.
+func readObjectFile(name string) (*ObjectFile, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	obj := new(ObjectFile)
+	if err := json.Unmarshal(data, obj); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if obj.Format != objectFormat || obj.Version != objectVersion {
+		return nil, fmt.Errorf("%s is not a version %d %s file", name, objectVersion, objectFormat)
+	}
+	return obj, nil
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 )
@@ -10,15 +16,138 @@ import (
 type Parser struct {
 	s   *Scanner
 	buf struct {
-		tok Token  // Last read token.
-		lit string // Last read literal
-		n   int    // buffer size (max=1)
+		tok Token    // Last read token.
+		lit string   // Last read literal
+		pos Position // Where the last read token began.
+		n   int      // buffer size (max=1)
 	}
+	// Tokens pushed back with pushBack, which are read before the scanner.
+	pending []Lexeme
+
+	// Register aliases defined with .DEFINEREG, mapping names to register
+	// numbers. These are resolved at parse time, wherever a register is
+	// expected.
+	regAliases map[string]uint16
+
+	// The files suspended by .INCLUDE, innermost last. When an included file
+	// ends, parsing carries on from the one that included it.
+	includers []*Scanner
+	// Where .INCLUDE looks for files, from -I. See include.
+	includePaths []string
+	// The contents of every .INCLUDEd file, by path.
+	included map[string][]byte
+	// Lines whose indentation mixes tabs and spaces, for -Windent.
+	mixedIndent []Position
+	// Every string expanded into .DAT or .BYTE values, for -charset.
+	stringUses []StringUse
+
+	// The names defined so far, for .IFDEF and .IFNDEF, and the blocks of
+	// those the parser is inside, innermost last. See conditional.go.
+	defined map[string]bool
+	conds   []*condBlock
+
+	// String .DEFINEs, mapping names to their text. Like register aliases,
+	// they're expanded by the parser, so they must be defined before use.
+	stringDefines map[string]string
+
+	// All the label references parsed so far.
+	labelUses []*LabelUse
+	// And all the .len and .end references, which get their lengths once the
+	// whole file is parsed.
+	labelAttrs []*LabelAttr
+
+	// Anonymous labels are numbered in order, so 1b and 1f can be turned into
+	// ordinary label names as they're parsed. The references are checked once
+	// the whole file has been read.
+	anonCount int
+	anonRefs  []anonRef
+
+	// How string literals are encoded, set by .STRINGS.
+	encoding stringEncoding
+
+	// How deeply the expression being parsed is nested in brackets, and the
+	// limit, so that pathological input gets an error rather than overflowing
+	// the stack.
+	depth    int
+	maxDepth int
+}
+
+// defaultMaxDepth is the default limit on nested brackets in an expression,
+// which -max-depth changes.
+const defaultMaxDepth = 256
+
+// exprError is an error in an expression that's definitely there, as opposed to
+// there being no expression at all. It's passed up as-is, rather than being
+// wrapped at every level of brackets or letting the caller try something else.
+type exprError struct{ msg string }
+
+func (e *exprError) Error() string { return e.msg }
+
+func isExprError(err error) bool {
+	_, ok := err.(*exprError)
+	return ok
+}
+
+// parseNumber converts a NUMBER token to its value. The scanner has already
+// checked the digits, so only the base needs working out: a leading 0 is just
+// a 0, not an octal prefix as for strconv.
+func parseNumber(lit string) (int64, error) {
+	base := 10
+	if len(lit) >= 2 && lit[0] == '0' {
+		switch lit[1] {
+		case 'x', 'X':
+			lit, base = lit[2:], 16
+		case 'b', 'B':
+			lit, base = lit[2:], 2
+		}
+	}
+	return strconv.ParseInt(lit, base, 64) // Only fails when out of range.
+}
+
+// stringEncoding is a .STRINGS mode.
+type stringEncoding int
+
+const (
+	codePointStrings stringEncoding = iota // A word (or byte) per code point
+	utf8Strings                            // UTF-8 bytes, packed in .DAT
+	packedStrings                          // A byte per code point, packed in .DAT
+)
+
+var stringEncodings = map[string]stringEncoding{
+	"CODEPOINTS": codePointStrings,
+	"UTF8":       utf8Strings,
+	"PACKED":     packedStrings,
+}
+
+// stringMode says whether an expression list accepts string literals, and if
+// so what each element of the result holds.
+type stringMode int
+
+const (
+	noStrings   stringMode = iota
+	wordStrings            // .DAT: a word per character
+	byteStrings            // .BYTE: a byte per character
+)
+
+// anonRef is a reference to an anonymous label, eg. 2f or 1b.
+type anonRef struct {
+	use  *LabelUse
+	lit  string
+	from int // Number of anonymous labels before the reference.
+	n    int // Negative for backward references.
+}
+
+// anonLabel gives the internal name of the nth anonymous label. It can't clash
+// with a real label, since @ is never part of an identifier.
+func anonLabel(n int) string {
+	return fmt.Sprintf("@anon%d", n)
 }
 
 // NewParser returns a new Parser instance.
 func NewParser(filename string, r io.Reader) *Parser {
-	return &Parser{s: NewScanner(filename, r)}
+	return &Parser{s: NewScanner(filename, r), regAliases: make(map[string]uint16),
+		stringDefines: make(map[string]string), included: make(map[string][]byte),
+		defined: map[string]bool{buildIDSymbol: true}, maxDepth: defaultMaxDepth}
 }
 
 // scan returns the next token from the underlying scanner.
@@ -30,19 +159,57 @@ func (p *Parser) scan() (Token, string) {
 		return p.buf.tok, p.buf.lit
 	}
 
-	// Otherwise read the next token from the scanner.
-	tok, lit := p.s.Scan()
+	// Otherwise read the next token from the scanner, or any pushed back.
+	var tok Token
+	var lit string
+	var pos Position
+	if len(p.pending) > 0 {
+		tok, lit, pos = p.pending[0].Token, p.pending[0].Lit, p.pending[0].Pos
+		p.pending = p.pending[1:]
+	} else {
+		tok, lit = p.s.Scan()
+		pos = p.s.TokenPos()
+		if tok == WS && pos.Col == 1 && isMixedIndent(lit) && p.s.peek() != '\n' && p.s.peek() != eof {
+			p.mixedIndent = append(p.mixedIndent, pos)
+		}
+	}
 
 	// Save it to the buffer in case we unscan later.
-	p.buf.tok, p.buf.lit = tok, lit
+	p.buf.tok, p.buf.lit, p.buf.pos = tok, lit, pos
 	return tok, lit
 }
 
-// Unscan pushes previously read token back onto the buffer.
+// isMixedIndent reports whether ws, the whitespace at the start of a line, has
+// both tabs and spaces in it. Comments are WS tokens too, but never start with
+// whitespace. Blank lines don't count, but the caller has to check that.
+func isMixedIndent(ws string) bool {
+	return (ws[0] == ' ' || ws[0] == '\t') && strings.ContainsRune(ws, ' ') && strings.ContainsRune(ws, '\t')
+}
+
+// pos returns where the last token read (or unscanned) began.
+func (p *Parser) pos() Position {
+	return p.buf.pos
+}
+
+// Unscan pushes previously read token back onto the buffer. There's only room
+// for one: unscanning twice in a row restores the same token, not the one
+// before it. Use pushBack for more.
 func (p *Parser) unscan() {
 	p.buf.n = 1
 }
 
+// pushBack returns several tokens to be read again, in order, for when one
+// token of lookahead isn't enough.
+func (p *Parser) pushBack(toks ...Lexeme) {
+	// An unscanned token was read after all of these, so it follows them
+	// rather than being lost.
+	if p.buf.n != 0 {
+		toks = append(toks, Lexeme{p.buf.tok, p.buf.lit, p.buf.pos})
+		p.buf.n = 0
+	}
+	p.pending = append(toks, p.pending...)
+}
+
 // scanIgnoreWhitespace is a wrapper that skips whitespace tokens.
 // NEWLINE is not a whitespace token according to this; those are important.
 func (p *Parser) scanIgnoreWhitespace() (Token, string) {
@@ -54,20 +221,49 @@ func (p *Parser) scanIgnoreWhitespace() (Token, string) {
 }
 
 func (p *Parser) wrapError(e error) error {
-	return fmt.Errorf("Parse error at %s   %v", p.s.Location(), e)
+	// A malformed token is the real cause of whatever confused the parser.
+	if p.s.err != nil {
+		return p.s.err
+	}
+	return &Error{p.pos(), e.Error()}
 }
 
 // Actual top-level parser. Returns our AST object.
 func (p *Parser) Parse() (*AST, error) {
 	lines := make([]Assembled, 0, 256)
+	srcLines := make([]uint, 0, 256)
+	srcFiles := make([]string, 0, 256)
 	for {
 		tok, lit := p.scanIgnoreWhitespace()
+		line, file := p.s.line, p.s.file
+		if tok == DOT {
+			if ok, err := p.conditional(); err != nil {
+				return nil, p.wrapError(err)
+			} else if ok {
+				continue
+			}
+		}
+		if !p.keep() && tok != EOF {
+			// Left out by an .IFDEF or .IFNDEF, so it isn't parsed at all.
+			for tok != NEWLINE && tok != EOF {
+				tok, _ = p.scan()
+			}
+			if tok == EOF {
+				p.unscan()
+			}
+			p.s.err = nil // Nor do malformed tokens matter.
+			continue
+		}
+
 		if tok == DOT {
 			l, err := p.parseDirective()
 			if err != nil {
 				return nil, p.wrapError(err)
 			}
+			p.noteDefined(l)
 			lines = append(lines, l)
+			srcLines = append(srcLines, line)
+			srcFiles = append(srcFiles, file)
 		} else if tok == IDENT { // Should be an instruction.
 			upper := strings.ToUpper(lit)
 			l, err := p.parseInstruction(upper)
@@ -75,22 +271,89 @@ func (p *Parser) Parse() (*AST, error) {
 				return nil, p.wrapError(err)
 			}
 			lines = append(lines, l)
+			srcLines = append(srcLines, line)
+			srcFiles = append(srcFiles, file)
 		} else if tok == COLON { // Label definition
+			colon := p.pos()
 			tok, lit = p.scan() // WS not allowed.
-			if tok == IDENT {
-				lines = append(lines, &LabelDef{lit})
+			if lit == lineSymbol || lit == fileSymbol {
+				return nil, p.wrapError(fmt.Errorf("'%s' is predefined, so it can't be a label", lit))
+			} else if tok == IDENT {
+				lines = append(lines, &LabelDef{lit, p.pos()})
+				p.noteDefined(lines[len(lines)-1])
+				srcLines = append(srcLines, line)
+				srcFiles = append(srcFiles, file)
+			} else if tok == WS || tok == NEWLINE || tok == EOF {
+				// A bare colon is an anonymous label.
+				p.unscan()
+				lines = append(lines, &LabelDef{anonLabel(p.anonCount), colon})
+				srcLines = append(srcLines, line)
+				srcFiles = append(srcFiles, file)
+				p.anonCount++
 			} else {
 				return nil, p.wrapError(fmt.Errorf("Bad label: '%s'", lit))
 			}
 		} else if tok == NEWLINE {
 			continue
 		} else if tok == EOF {
+			if err := p.unclosed(); err != nil {
+				return nil, err
+			}
+			if n := len(p.includers); n > 0 {
+				// Back to the file with the .INCLUDE.
+				p.s, p.includers = p.includers[n-1], p.includers[:n-1]
+				continue
+			}
 			break
 		} else {
 			return nil, p.wrapError(fmt.Errorf("Unexpected %s", tokenNames[tok]))
 		}
 	}
-	return &AST{lines}, nil
+	if err := p.resolveLabelAttrs(lines); err != nil {
+		return nil, err
+	}
+	for _, ref := range p.anonRefs {
+		if ref.n < 0 && ref.from+ref.n < 0 {
+			return nil, &Error{ref.use.loc, fmt.Sprintf("No anonymous label for %s; there are only %d before it", ref.lit, ref.from)}
+		} else if ref.n > 0 && ref.from+ref.n > p.anonCount {
+			return nil, &Error{ref.use.loc, fmt.Sprintf("No anonymous label for %s; there are only %d after it", ref.lit, p.anonCount-ref.from)}
+		}
+	}
+	return &AST{lines, srcLines, srcFiles, p.s.file, p.labelUses, p.included, p.mixedIndent, p.stringUses}, nil
+}
+
+// resolveLabelAttrs fills in the data length for each label.len and label.end.
+// The label must be followed by a .DAT, whose length is known at parse time.
+func (p *Parser) resolveLabelAttrs(lines []Assembled) error {
+	lengths := make(map[string]uint16)
+	for i, l := range lines {
+		def, ok := l.(*LabelDef)
+		if !ok {
+			continue
+		}
+		// Skip over any other labels at the same address.
+		j := i + 1
+		for j < len(lines) {
+			if _, ok := lines[j].(*LabelDef); !ok {
+				break
+			}
+			j++
+		}
+		if j < len(lines) {
+			if dat, ok := lines[j].(*DatBlock); ok {
+				lengths[def.label] = uint16(len(dat.values))
+			}
+		}
+	}
+
+	for _, la := range p.labelAttrs {
+		n, ok := lengths[la.label.label]
+		if !ok {
+			return &Error{la.label.loc, fmt.Sprintf("'%s' doesn't label a .DAT block, so %s.%s isn't defined", la.label.label, la.label.label, la.attr)}
+		}
+		la.length = n
+	}
+	return nil
 }
 
 func (p *Parser) parseDirective() (Assembled, error) {
@@ -102,90 +365,397 @@ func (p *Parser) parseDirective() (Assembled, error) {
 	switch strings.ToUpper(lit) {
 	case "DAT":
 		// Comma-separated expressions.
-		args, err := p.parseExprList(true /* strings allowed */)
+		args, err := p.parseExprList(wordStrings)
 		if err != nil {
 			return nil, fmt.Errorf("Failed to parse .DAT values: %v", err)
 		}
-		if !p.consume(NEWLINE) {
+		if !p.consumeEOL() {
 			t, lit := p.scanIgnoreWhitespace()
 			return nil, fmt.Errorf("Unexpected %s '%s' at end of DAT", tokenNames[t], lit)
 		}
 		return &DatBlock{args}, nil
 
+	case "WORD", "OPCODE":
+		// A single raw word. The same as a one-value .DAT, but kept distinct so
+		// listings and tools can tell hand-encoded instructions from data.
+		name := strings.ToUpper(lit)
+		expr, err := p.parseSimpleExpr()
+		if err != nil {
+			return nil, fmt.Errorf("Bad expression for .%s: %v", name, err)
+		}
+		if !p.consumeEOL() {
+			t, lit := p.scanIgnoreWhitespace()
+			return nil, fmt.Errorf("Unexpected %s '%s' at end of %s", tokenNames[t], lit, name)
+		}
+		return &RawWord{expr, name == "OPCODE"}, nil
+
+	case "BYTE":
+		// Comma-separated byte values, packed two to a word.
+		args, err := p.parseExprList(byteStrings)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse .BYTE values: %v", err)
+		}
+		if !p.consumeEOL() {
+			t, lit := p.scanIgnoreWhitespace()
+			return nil, fmt.Errorf("Unexpected %s '%s' at end of BYTE", tokenNames[t], lit)
+		}
+		return &ByteBlock{args}, nil
+
+	case "STRINGS":
+		t, lit := p.scanIgnoreWhitespace()
+		mode, ok := stringEncodings[strings.ToUpper(lit)]
+		if t != IDENT || !ok {
+			return nil, fmt.Errorf(".STRINGS must be CODEPOINTS, UTF8 or PACKED; found %s '%s'", tokenNames[t], lit)
+		}
+		if !p.consumeEOL() {
+			t, lit := p.scanIgnoreWhitespace()
+			return nil, fmt.Errorf("Unexpected %s '%s' at end of STRINGS", tokenNames[t], lit)
+		}
+		p.encoding = mode
+		return &StringEncoding{strings.ToLower(lit)}, nil
+
+	case "ENDIAN":
+		t, lit := p.scanIgnoreWhitespace()
+		if t != IDENT || (strings.ToUpper(lit) != "BIG" && strings.ToUpper(lit) != "LITTLE") {
+			return nil, fmt.Errorf(".ENDIAN must be BIG or LITTLE; found %s '%s'", tokenNames[t], lit)
+		}
+		if !p.consumeEOL() {
+			t, lit := p.scanIgnoreWhitespace()
+			return nil, fmt.Errorf("Unexpected %s '%s' at end of ENDIAN", tokenNames[t], lit)
+		}
+		return &Endian{strings.ToUpper(lit) == "LITTLE"}, nil
+
+	case "INCBIN":
+		t, name := p.scanIgnoreWhitespace()
+		if t != STRING {
+			return nil, fmt.Errorf(".INCBIN requires a filename string; found %s", tokenNames[t])
+		}
+
+		// An optional byte order overrides .ENDIAN for this file only.
+		order := 0
+		if p.consumeComma() {
+			t, lit := p.scanIgnoreWhitespace()
+			switch strings.ToUpper(lit) {
+			case "BE", "BIG":
+				order = bigEndian
+			case "LE", "LITTLE":
+				order = littleEndian
+			default:
+				return nil, fmt.Errorf("Expected BE or LE after .INCBIN filename; found %s '%s'", tokenNames[t], lit)
+			}
+		}
+		if !p.consumeEOL() {
+			t, lit := p.scanIgnoreWhitespace()
+			return nil, fmt.Errorf("Unexpected %s '%s' at end of INCBIN", tokenNames[t], lit)
+		}
+
+		// Paths are relative to the including file.
+		path := name
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(p.s.file), path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read .INCBIN file: %v", err)
+		}
+		return &IncBin{data, order}, nil
+
+	case "INCLUDE":
+		// "file" looks next to the current file first; <file> only on the -I
+		// paths.
+		t, name := p.scanIgnoreWhitespace()
+		angle := t == LT
+		if angle {
+			var ok bool
+			if name, ok = p.s.scanUntil('>'); !ok {
+				return nil, fmt.Errorf(".INCLUDE <%s is missing its closing >", name)
+			}
+		} else if t != STRING {
+			return nil, fmt.Errorf(".INCLUDE requires a \"file\" or <file> name; found %s", tokenNames[t])
+		}
+		if !p.consumeEOL() {
+			t, lit := p.scanIgnoreWhitespace()
+			return nil, fmt.Errorf("Unexpected %s '%s' at end of INCLUDE", tokenNames[t], lit)
+		}
+		if err := p.include(name, angle); err != nil {
+			return nil, err
+		}
+		return &Include{name}, nil
+
 	case "ORG":
 		expr, err := p.parseSimpleExpr()
 		if err != nil {
 			return nil, fmt.Errorf("Bad expression for .ORG: %v", err)
 		}
-		if !p.consume(NEWLINE) {
+		if !p.consumeEOL() {
 			t, lit := p.scanIgnoreWhitespace()
 			return nil, fmt.Errorf("Unexpected %s '%s' at end of ORG", tokenNames[t], lit)
 		}
 		return &Org{expr}, nil
 
 	case "FILL":
-		values, err := p.parseExprList(false /* no strings */)
+		// Either .FILL value, count or the keyword form, with count= and value=
+		// in either order.
+		t1, lit1 := p.scanIgnoreWhitespace()
+		if t1 == IDENT && (strings.ToLower(lit1) == "count" || strings.ToLower(lit1) == "value") {
+			pos1 := p.pos()
+			t2, lit2 := p.scanIgnoreWhitespace()
+			if t2 == EQUALS {
+				p.pushBack(Lexeme{t1, lit1, pos1}, Lexeme{t2, lit2, p.pos()})
+				return p.parseKeywordFill()
+			}
+			p.pushBack(Lexeme{t1, lit1, pos1}, Lexeme{t2, lit2, p.pos()})
+		} else {
+			p.unscan()
+		}
+
+		values, err := p.parseExprList(noStrings)
 		if err != nil {
 			return nil, fmt.Errorf("Failed to parse .FILL arguments: %v", err)
 		}
 		if len(values) != 2 {
 			return nil, fmt.Errorf(".FILL requires two arguments, found %d", len(values))
 		}
-		if !p.consume(NEWLINE) {
+		if !p.consumeEOL() {
 			t, lit := p.scanIgnoreWhitespace()
 			return nil, fmt.Errorf("Unexpected %s '%s' at end of FILL", tokenNames[t], lit)
 		}
-		return &FillBlock{values[1], values[0]}, nil
+		return &FillBlock{values[1], values[0], false}, nil
 
 	case "RESERVE":
-		loc := p.s.Location()
 		expr, err := p.parseSimpleExpr()
 		if err != nil {
 			return nil, fmt.Errorf("Bad expression for .RESERVE: %v", err)
 		}
-		if !p.consume(NEWLINE) {
+		if !p.consumeEOL() {
 			t, lit := p.scanIgnoreWhitespace()
 			return nil, fmt.Errorf("Unexpected %s '%s' at end of RESERVE", tokenNames[t], lit)
 		}
-		return &FillBlock{&Constant{0, loc}, expr}, nil
+		return &Reserve{expr}, nil
+
+	case "ALIGN":
+		expr, err := p.parseSimpleExpr()
+		if err != nil {
+			return nil, fmt.Errorf("Bad expression for .ALIGN: %v", err)
+		}
+		if !p.consumeEOL() {
+			t, lit := p.scanIgnoreWhitespace()
+			return nil, fmt.Errorf("Unexpected %s '%s' at end of ALIGN", tokenNames[t], lit)
+		}
+		return &Align{expr}, nil
+
+	case "PADVALUE":
+		expr, err := p.parseSimpleExpr()
+		if err != nil {
+			return nil, fmt.Errorf("Bad expression for .PADVALUE: %v", err)
+		}
+		if !p.consumeEOL() {
+			t, lit := p.scanIgnoreWhitespace()
+			return nil, fmt.Errorf("Unexpected %s '%s' at end of PADVALUE", tokenNames[t], lit)
+		}
+		return &PadValue{expr}, nil
 
-	case "DEFINE":
+	case "DEFINE", "CONST", "SET":
+		name := strings.ToUpper(lit)
 		t, lit := p.scanIgnoreWhitespace()
-		if t != IDENT {
-			return nil, fmt.Errorf(".DEFINE's first argument must be an identifier; found %s", tokenNames[t])
+		if t == REGISTER || t == PC || t == SP || t == LR {
+			return nil, fmt.Errorf(".%s name '%s' is a register name, and would never be used; pick another name", name, lit)
+		} else if t != IDENT {
+			return nil, fmt.Errorf(".%s's first argument must be an identifier; found %s", name, tokenNames[t])
+		} else if lit == lineSymbol || lit == fileSymbol {
+			return nil, fmt.Errorf("'%s' is predefined, so it can't be redefined", lit)
 		}
+		loc := p.pos()
 
 		if !p.consumeComma() {
-			return nil, fmt.Errorf("No comma after .DEFINE identifier")
+			return nil, fmt.Errorf("No comma after .%s identifier", name)
 		}
 
+		if t, text := p.scanIgnoreWhitespace(); t == STRING {
+			if name != "DEFINE" {
+				return nil, fmt.Errorf(".%s values must be numbers; use .DEFINE for strings", name)
+			}
+			if !p.consumeEOL() {
+				t, lit := p.scanIgnoreWhitespace()
+				return nil, fmt.Errorf("Unexpected %s '%s' at end of DEFINE", tokenNames[t], lit)
+			}
+			p.stringDefines[lit] = text
+			return &StringDef{lit, text}, nil
+		}
+		p.unscan()
+		delete(p.stringDefines, lit)
+
 		expr, err := p.parseSimpleExpr()
 		if err != nil {
-			return nil, fmt.Errorf("Bad expression for .DEFINE: %v", err)
+			return nil, fmt.Errorf("Bad expression for .%s: %v", name, err)
 		}
-		if !p.consume(NEWLINE) {
+		if !p.consumeEOL() {
 			t, lit := p.scanIgnoreWhitespace()
-			return nil, fmt.Errorf("Unexpected %s '%s' at end of DEFINE", tokenNames[t], lit)
+			return nil, fmt.Errorf("Unexpected %s '%s' at end of %s", tokenNames[t], lit, name)
 		}
-		return &SymbolDef{lit, expr}, nil
+		return &SymbolDef{lit, expr, loc, name == "CONST", name == "SET"}, nil
+
+	case "DEFINEREG":
+		t, name := p.scanIgnoreWhitespace()
+		if t == REGISTER || t == PC || t == SP || t == LR {
+			return nil, fmt.Errorf(".DEFINEREG alias '%s' shadows a register name", name)
+		} else if t != IDENT {
+			return nil, fmt.Errorf(".DEFINEREG's first argument must be an identifier; found %s", tokenNames[t])
+		}
+
+		if !p.consumeComma() {
+			return nil, fmt.Errorf("No comma after .DEFINEREG identifier")
+		}
+
+		r, err := p.parseReg()
+		if err != nil {
+			return nil, fmt.Errorf("Bad register for .DEFINEREG: %v", err)
+		}
+		if !p.consumeEOL() {
+			t, lit := p.scanIgnoreWhitespace()
+			return nil, fmt.Errorf("Unexpected %s '%s' at end of DEFINEREG", tokenNames[t], lit)
+		}
+		p.regAliases[name] = r
+		return &RegAliasDef{name, r}, nil
+
+	case "ERROR", "WARNING":
+		name := strings.ToUpper(lit)
+		loc := p.pos()
+		t, msg := p.scanIgnoreWhitespace()
+		if t != STRING {
+			return nil, fmt.Errorf(".%s requires a string message; found %s", name, tokenNames[t])
+		}
+		if !p.consumeEOL() {
+			t, lit := p.scanIgnoreWhitespace()
+			return nil, fmt.Errorf("Unexpected %s '%s' at end of %s", tokenNames[t], lit, name)
+		}
+		return &Message{name == "ERROR", msg, loc}, nil
+
+	case "ASSERT":
+		loc := p.pos()
+		cond, err := p.parseSimpleExpr()
+		if err != nil {
+			return nil, fmt.Errorf("Bad expression for .ASSERT: %v", err)
+		}
+		msg := ""
+		if p.consumeComma() {
+			t, lit := p.scanIgnoreWhitespace()
+			if t != STRING {
+				return nil, fmt.Errorf(".ASSERT message must be a string; found %s", tokenNames[t])
+			}
+			msg = lit
+		}
+		if !p.consumeEOL() {
+			t, lit := p.scanIgnoreWhitespace()
+			return nil, fmt.Errorf("Unexpected %s '%s' at end of ASSERT", tokenNames[t], lit)
+		}
+		return &Assert{cond, msg, loc}, nil
 
 		// TODO: Macros
 	}
 
+	if d := closestName(strings.ToUpper(lit), directives); d != "" {
+		return nil, fmt.Errorf("Unknown directive: %s; did you mean .%s?", lit, d)
+	}
 	return nil, fmt.Errorf("Unknown directive: %s", lit)
 }
 
-// "Simple expression" is kind of a misnomer; it's actually any expression other
-// than a string literal, since those are only allowed in DAT lines.
-// "Simple" expressions can actually be a whole parse tree.
-// The grammar looks like this:
-// expr  := expr1 | expr1 addOp expr
-// expr1 := expr2 | expr2 mulOp exp1
-// expr2 := unaryOp? expr3
-// expr3 := identifier | literal | ( expr )
-// mulOp := * / & << >>
-// addOp := + - | ^
-// unaryOp := - ~
+// maxIncludeDepth is how deeply .INCLUDEs can nest. It's only reached by
+// mistake, since a file including itself is caught directly.
+const maxIncludeDepth = 64
+
+// include carries on parsing from the start of the named file, and returns to
+// the current one when it ends. "file" (angle false) is looked for relative to
+// the current file, then on each -I path in turn; <file> only on the -I paths.
+// An absolute name is only looked for as it is.
+func (p *Parser) include(name string, angle bool) error {
+	var dirs []string
+	if filepath.IsAbs(name) {
+		dirs = []string{""}
+	} else {
+		if !angle {
+			dirs = append(dirs, filepath.Dir(p.s.file))
+		}
+		dirs = append(dirs, p.includePaths...)
+	}
+
+	var tried []string
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		data, err := os.ReadFile(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			tried = append(tried, path)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("Failed to read .INCLUDE file: %v", err)
+		}
+
+		for _, s := range append(p.includers, p.s) {
+			if filepath.Clean(s.file) == path {
+				return fmt.Errorf("%s includes itself, through .INCLUDE '%s'", path, name)
+			}
+		}
+		if len(p.includers) == maxIncludeDepth {
+			return fmt.Errorf(".INCLUDEs are nested more than %d deep", maxIncludeDepth)
+		}
+
+		s := NewScanner(path, bytes.NewReader(data))
+		s.altComments = p.s.altComments
+		s.identChars = p.s.identChars
+		p.includers = append(p.includers, p.s)
+		p.s = s
+		p.buf.n = 0 // An unscanned EOF is seen again on the way back.
+		p.included[path] = data
+		return nil
+	}
+	quoted := `"` + name + `"`
+	if angle {
+		quoted = "<" + name + ">"
+	}
+	if len(tried) == 0 {
+		return fmt.Errorf("Can't find .INCLUDE file %s: there are no -I paths to look in", quoted)
+	}
+	return fmt.Errorf("Can't find .INCLUDE file %s; looked for %s", quoted, strings.Join(tried, ", "))
+}
+
+// parseKeywordFill parses the .FILL count=N, value=V form.
+func (p *Parser) parseKeywordFill() (Assembled, error) {
+	args := make(map[string]Expression)
+	for {
+		t, name := p.scanIgnoreWhitespace()
+		name = strings.ToLower(name)
+		if t != IDENT || (name != "count" && name != "value") {
+			return nil, fmt.Errorf("Expected count= or value= in .FILL, but found %s '%s'", tokenNames[t], name)
+		}
+		if _, ok := args[name]; ok {
+			return nil, fmt.Errorf("Duplicate %s= in .FILL", name)
+		}
+		if !p.consume(EQUALS) {
+			return nil, fmt.Errorf("Expected = after %s in .FILL", name)
+		}
+		expr, err := p.parseSimpleExpr()
+		if err != nil {
+			return nil, fmt.Errorf("Bad expression for .FILL %s: %v", name, err)
+		}
+		args[name] = expr
+
+		if !p.consumeComma() {
+			break
+		}
+	}
+	if !p.consumeEOL() {
+		t, lit := p.scanIgnoreWhitespace()
+		return nil, fmt.Errorf("Unexpected %s '%s' at end of FILL", tokenNames[t], lit)
+	}
+	if args["count"] == nil || args["value"] == nil {
+		return nil, fmt.Errorf(".FILL requires both count= and value=")
+	}
+	return &FillBlock{args["count"], args["value"], true}, nil
+}
+
+// parseOperatorChain parses one precedence level: subexpressions parsed by
+// parseSubExpr, separated by the operators parseOperator accepts, grouped to
+// the left.
 func (p *Parser) parseOperatorChain(parseSubExpr func(p *Parser) (Expression, error), parseOperator func(p *Parser) (Token, error)) (Expression, error) {
 	// We parse a loop of subexpressions, separated by ops.
 	exprs := make([]Expression, 0, 2)
@@ -193,7 +763,9 @@ func (p *Parser) parseOperatorChain(parseSubExpr func(p *Parser) (Expression, er
 
 	for {
 		e, err := parseSubExpr(p)
-		if err != nil {
+		if isExprError(err) {
+			return nil, err
+		} else if err != nil {
 			break
 		}
 		exprs = append(exprs, e)
@@ -220,44 +792,124 @@ func (p *Parser) parseOperatorChain(parseSubExpr func(p *Parser) (Expression, er
 	return final, nil
 }
 
+// parseConstant parses and evaluates text as a constant expression, such as a
+// command-line value. Labels and defines aren't available. As with narrow, the
+// value has to fit in 16 bits.
+func parseConstant(text string) (value uint16, err error) {
+	p := NewParser(text, strings.NewReader(text))
+	expr, err := p.parseSimpleExpr()
+	if p.s.err != nil {
+		return 0, fmt.Errorf("%s", p.s.err.Msg)
+	} else if err != nil {
+		return 0, err
+	}
+	if t, lit := p.scanIgnoreWhitespace(); t != EOF {
+		return 0, fmt.Errorf("Unexpected %s '%s' in constant '%s'", tokenNames[t], lit, text)
+	}
+	if len(p.labelUses) > 0 {
+		return 0, fmt.Errorf("'%s' must be a constant, but uses '%s'", text, p.labelUses[0].label)
+	}
+	// Evaluation errors, like a division by zero, are *Error panics.
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*Error)
+			if !ok {
+				panic(r)
+			}
+			value, err = 0, fmt.Errorf("%s", e.Msg)
+		}
+	}()
+	v := wideValue(expr, new(AssemblyState))
+	if v > 0xffff || v < -0xffff {
+		return 0, fmt.Errorf("Value %d (%#x) doesn't fit in 16 bits", v, v)
+	}
+	return uint16(v), nil
+}
+
+// "Simple expression" is kind of a misnomer; it's actually any expression other
+// than a string literal, since those are only allowed in DAT lines.
+// Binary operators follow C's precedence, except that comparisons are looser
+// than everything else. The grammar, from loosest to tightest, is:
+// expr    := or ((== != < <= > >=) or)*
+// or      := xor (| xor)*
+// xor     := and (^ and)*
+// and     := shift (& shift)*
+// shift   := add ((<< >> >>>) add)*
+// add     := mul ((+ -) mul)*
+// mul     := unary ((* /) unary)*
+// unary   := (+ - ~)* term
+// term    := number | $ | 1b | 1f | builtin ( args ) | ( expr )
+// term    := identifier | identifier.len | identifier.end
 func (p *Parser) parseSimpleExpr() (Expression, error) {
-	return p.parseOperatorChain(parseMulExpr, parseAddOp)
+	p.depth++
+	defer func() { p.depth-- }()
+	// The outermost expression isn't in brackets, so it doesn't count.
+	if p.depth-1 > p.maxDepth {
+		return nil, &exprError{fmt.Sprintf("Expression nesting too deep: more than %d levels of brackets", p.maxDepth)}
+	}
+	return p.parseOperatorChain(parseOrExpr, operatorParser(EQ, NE, LT, LE, GT, GE))
 }
 
-func parseMulExpr(p *Parser) (Expression, error) {
-	return p.parseOperatorChain(parseUnaryExpr, parseMulOp)
+func parseOrExpr(p *Parser) (Expression, error) {
+	return p.parseOperatorChain(parseXorExpr, operatorParser(OR))
 }
 
-func parseAddOp(p *Parser) (Token, error) {
-	tok, _ := p.scanIgnoreWhitespace()
-	switch tok {
-	case PLUS, MINUS, OR, XOR:
-		return tok, nil
-	default:
-		p.unscan()
-		return ILLEGAL, fmt.Errorf("Found non-additive operator %s at %s", tokenNames[tok], p.s.Location())
-	}
+func parseXorExpr(p *Parser) (Expression, error) {
+	return p.parseOperatorChain(parseAndExpr, operatorParser(XOR))
 }
 
-func parseMulOp(p *Parser) (Token, error) {
-	tok, _ := p.scanIgnoreWhitespace()
-	switch tok {
-	case TIMES, DIVIDE, AND:
-		return tok, nil
-	default:
+func parseAndExpr(p *Parser) (Expression, error) {
+	return p.parseOperatorChain(parseShiftExpr, operatorParser(AND))
+}
+
+func parseShiftExpr(p *Parser) (Expression, error) {
+	return p.parseOperatorChain(parseAddExpr, operatorParser(LANGLES, RANGLES, ASR))
+}
+
+func parseAddExpr(p *Parser) (Expression, error) {
+	return p.parseOperatorChain(parseMulExpr, operatorParser(PLUS, MINUS))
+}
+
+func parseMulExpr(p *Parser) (Expression, error) {
+	return p.parseOperatorChain(parseUnaryExpr, operatorParser(TIMES, DIVIDE))
+}
+
+// __LINE__ and __FILE__ are replaced by the parser with the line number and
+// file name where they're used, so they can't be labels or .DEFINEs.
+const (
+	lineSymbol = "__LINE__"
+	fileSymbol = "__FILE__"
+)
+
+// errNoOperator ends an operator chain. It's never shown, so it's a constant
+// rather than something formatted on every expression.
+var errNoOperator = errors.New("no operator")
+
+// operatorParser returns a function that accepts any of the given operators,
+// for parseOperatorChain.
+func operatorParser(ops ...Token) func(p *Parser) (Token, error) {
+	return func(p *Parser) (Token, error) {
+		tok, _ := p.scanIgnoreWhitespace()
+		for _, op := range ops {
+			if tok == op {
+				return tok, nil
+			}
+		}
 		p.unscan()
-		return ILLEGAL, fmt.Errorf("Found non-multiplicative operator %s at %s", tokenNames[tok], p.s.Location())
+		return ILLEGAL, errNoOperator
 	}
 }
 
 func parseUnaryExpr(p *Parser) (Expression, error) {
 	// 0 or more unary expressions on the front.
 	ops := make([]Token, 0, 2)
+	locs := make([]Position, 0, 2)
 	for {
-		fmt.Printf("PUE loop\n")
+		debugf("PUE loop\n")
 		tok, _ := p.scanIgnoreWhitespace()
 		if tok == PLUS || tok == MINUS || tok == NOT {
 			ops = append(ops, tok)
+			locs = append(locs, p.pos())
 		} else {
 			p.unscan()
 			break
@@ -271,8 +923,9 @@ func parseUnaryExpr(p *Parser) (Expression, error) {
 		return nil, err
 	}
 
+	// The innermost operator is the last one, so -~x is -(~x).
 	for i := len(ops) - 1; i >= 0; i-- {
-		e = &UnaryExpr{ops[i], e}
+		e = &UnaryExpr{ops[i], e, locs[i]}
 	}
 
 	return e, nil
@@ -281,20 +934,67 @@ func parseUnaryExpr(p *Parser) (Expression, error) {
 func (p *Parser) parseTerm() (Expression, error) {
 	// Parse a simple term in the expression: a literal, an identifier, or a
 	// bracketed subexpression.
-	loc := p.s.Location()
 	tok, lit := p.scanIgnoreWhitespace()
+	loc := p.pos()
 	switch tok {
 	case IDENT:
-		return &LabelUse{lit, loc}, nil
-	case NUMBER:
-		n, err := strconv.ParseInt(lit, 0, 0)
+		if _, ok := p.stringDefines[lit]; ok {
+			return nil, &exprError{fmt.Sprintf("'%s' is a string .DEFINE, so it can only be used as a whole .DAT or .BYTE value", lit)}
+		} else if lit == fileSymbol {
+			return nil, &exprError{fmt.Sprintf("'%s' is a string, so it can only be used as a whole .DAT or .BYTE value", lit)}
+		} else if lit == lineSymbol {
+			return &Constant{int64(loc.Line), loc}, nil
+		}
+		if name := strings.ToUpper(lit); builtins[name] {
+			if t, _ := p.scan(); t == LPAREN {
+				return p.parseCall(name, loc)
+			}
+			p.unscan()
+		}
+		use := &LabelUse{lit, loc}
+		p.labelUses = append(p.labelUses, use)
+
+		// label.len or label.end, for labels in front of a .DAT.
+		if t, _ := p.scan(); t != DOT {
+			p.unscan()
+			return use, nil
+		}
+		t, attr := p.scan()
+		attr = strings.ToLower(attr)
+		if t != IDENT || (attr != "len" && attr != "end") {
+			return nil, fmt.Errorf("Expected len or end after '%s.', but found %s '%s'", lit, tokenNames[t], attr)
+		}
+		la := &LabelAttr{use, attr, 0}
+		p.labelAttrs = append(p.labelAttrs, la)
+		return la, nil
+	case ANON:
+		n, err := strconv.Atoi(lit[:len(lit)-1])
 		if err != nil {
 			return nil, err
 		}
-		return &Constant{uint16(n), loc}, nil
+		// 1b is the last anonymous label before here, 1f the first one after.
+		index := p.anonCount + n - 1
+		if strings.ToLower(lit[len(lit)-1:]) == "b" {
+			n = -n
+			index = p.anonCount + n
+		}
+		use := &LabelUse{anonLabel(index), loc}
+		p.labelUses = append(p.labelUses, use)
+		p.anonRefs = append(p.anonRefs, anonRef{use, lit, p.anonCount, n})
+		return use, nil
+	case DOLLAR:
+		return &Here{loc}, nil
+	case NUMBER:
+		n, err := parseNumber(lit)
+		if err != nil {
+			return nil, &exprError{fmt.Sprintf("Number literal '%s' is too large", lit)}
+		}
+		return &Constant{n, loc}, nil
 	case LPAREN:
 		subexpr, err := p.parseSimpleExpr()
-		if err != nil {
+		if isExprError(err) {
+			return nil, err
+		} else if err != nil {
 			return nil, fmt.Errorf("Error parsing bracketed subexpression: %v", err)
 		}
 		tok, lit = p.scanIgnoreWhitespace()
@@ -307,16 +1007,55 @@ func (p *Parser) parseTerm() (Expression, error) {
 	return nil, fmt.Errorf("Found %s while parsing expression", tokenNames[tok])
 }
 
-func (p *Parser) parseExpr() ([]Expression, error) {
+// parseCall parses the (arg) of a call to a builtin, whose name has already
+// been read.
+func (p *Parser) parseCall(name string, loc Position) (Expression, error) {
+	arg, err := p.parseSimpleExpr()
+	if isExprError(err) {
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("Bad argument to %s: %v", name, err)
+	}
+	if t, lit := p.scanIgnoreWhitespace(); t != RPAREN {
+		return nil, fmt.Errorf("Expected ) after the argument to %s, but found %s '%s'", name, tokenNames[t], lit)
+	}
+	return &Call{name, arg, loc}, nil
+}
+
+func (p *Parser) parseExpr(mode stringMode) ([]Expression, error) {
 	// Either a string literal or a simple expression.
-	loc := p.s.Location()
 	tok, lit := p.scanIgnoreWhitespace()
+	loc := p.pos()
 	if tok == STRING {
-		b := make([]Expression, len(lit))
-		for i, c := range lit {
-			b[i] = &Constant{uint16(c), loc}
+		return p.stringValues(lit, mode, loc)
+	}
+	if tok == HEXSTRING {
+		return hexValues(lit, mode, loc)
+	}
+	if text, ok := p.stringDefines[lit]; ok && tok == IDENT {
+		if t, _ := p.scanIgnoreWhitespace(); t != COMMA && t != NEWLINE && t != EOF {
+			return nil, fmt.Errorf("'%s' is a string .DEFINE, so it can only be used as a whole .DAT or .BYTE value", lit)
+		}
+		p.unscan()
+		return p.stringValues(text, mode, loc)
+	}
+	if tok == IDENT && lit == fileSymbol {
+		if t, _ := p.scanIgnoreWhitespace(); t != COMMA && t != NEWLINE && t != EOF {
+			return nil, fmt.Errorf("'%s' is a string, so it can only be used as a whole .DAT or .BYTE value", lit)
 		}
-		return b, nil
+		p.unscan()
+		return p.stringValues(loc.File, mode, loc)
+	}
+	if tok == EQUALS {
+		// =label is the address of a label.
+		tok, lit = p.scan() // No whitespace after the =.
+		loc = p.pos()
+		if tok != IDENT {
+			return nil, fmt.Errorf("Expected label after =, but found %s '%s'", tokenNames[tok], lit)
+		}
+		use := &LabelUse{lit, loc}
+		p.labelUses = append(p.labelUses, use)
+		return []Expression{&AddressOf{use}}, nil
 	}
 	// Unscan, otherwise, and try again.
 	p.unscan()
@@ -330,11 +1069,92 @@ func (p *Parser) parseExpr() ([]Expression, error) {
 	return buf, nil
 }
 
-func (p *Parser) parseExprList(allowStringLiterals bool) ([]Expression, error) {
+// stringValues turns a string literal into values. By default that's a value
+// per code point. With .STRINGS UTF8 it's the UTF-8 bytes, and with .STRINGS
+// PACKED a byte per code point; in .DAT, either is packed two to a word,
+// padded with 0.
+func (p *Parser) stringValues(lit string, mode stringMode, loc Position) ([]Expression, error) {
+	p.stringUses = append(p.stringUses, StringUse{lit, loc})
+	var values []int64
+	switch p.encoding {
+	case codePointStrings:
+		for _, c := range lit {
+			values = append(values, int64(c))
+		}
+	case utf8Strings:
+		for _, b := range []byte(lit) {
+			values = append(values, int64(b))
+		}
+	case packedStrings:
+		for _, c := range lit {
+			if c > 0xff {
+				return nil, fmt.Errorf("'%c' (U+%04X) doesn't fit in a byte, so it can't be in a packed string; try .STRINGS UTF8", c, c)
+			}
+			values = append(values, int64(c))
+		}
+	}
+
+	if p.encoding == codePointStrings || mode == byteStrings {
+		exprs := make([]Expression, len(values))
+		for i, v := range values {
+			exprs[i] = &Constant{v, loc}
+		}
+		return exprs, nil
+	}
+
+	if len(values)%2 != 0 {
+		values = append(values, 0)
+	}
+	exprs := make([]Expression, 0, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		exprs = append(exprs, &PackedBytes{uint8(values[i]), uint8(values[i+1]), loc})
+	}
+	return exprs, nil
+}
+
+// hexValues turns a hex byte string like x"DEADBEEF" into values: a byte each
+// in .BYTE, or packed two to a word in .DAT like a string. .STRINGS doesn't
+// apply; the bytes are exactly the ones written.
+func hexValues(lit string, mode stringMode, loc Position) ([]Expression, error) {
+	if len(lit)%2 != 0 {
+		return nil, fmt.Errorf("Hex byte string x\"%s\" has an odd number of digits; each byte takes two", lit)
+	}
+	data, err := hex.DecodeString(lit)
+	if err != nil {
+		return nil, fmt.Errorf("Hex byte string x\"%s\" can only contain hex digits", lit)
+	}
+
+	if mode == byteStrings {
+		exprs := make([]Expression, len(data))
+		for i, b := range data {
+			exprs[i] = &Constant{int64(b), loc}
+		}
+		return exprs, nil
+	}
+
+	if len(data)%2 != 0 {
+		data = append(data, 0)
+	}
+	exprs := make([]Expression, 0, len(data)/2)
+	for i := 0; i < len(data); i += 2 {
+		exprs = append(exprs, &PackedBytes{data[i], data[i+1], loc})
+	}
+	return exprs, nil
+}
+
+func (p *Parser) parseExprList(strs stringMode) ([]Expression, error) {
 	buf := make([]Expression, 0, 16)
 	for {
-		if allowStringLiterals {
-			exprs, err := p.parseExpr()
+		if t, _ := p.scanIgnoreWhitespace(); t == NEWLINE || t == EOF {
+			if len(buf) > 0 {
+				return nil, fmt.Errorf("Expected another value after the last comma, but found %s", tokenNames[t])
+			}
+			return nil, fmt.Errorf("Expected at least one value, but found %s", tokenNames[t])
+		}
+		p.unscan()
+
+		if strs != noStrings {
+			exprs, err := p.parseExpr(strs)
 			if err != nil {
 				return nil, err
 			}
@@ -361,6 +1181,11 @@ func (p *Parser) parseExprList(allowStringLiterals bool) ([]Expression, error) {
 }
 
 // Returns false if we can't find that token next.
+//
+// Any whitespace before the token is skipped either way, and isn't restored
+// when the token is unscanned; only the token matters to the caller that reads
+// it next. Code that needs to know whether tokens are adjacent, like PAGE( or
+// label.len, uses scan directly instead.
 func (p *Parser) consume(t Token) bool {
 	tok, _ := p.scanIgnoreWhitespace()
 	if tok != t {
@@ -369,12 +1194,27 @@ func (p *Parser) consume(t Token) bool {
 	return tok == t
 }
 
+// consumeEOL consumes the end of a line. The end of the file counts too, so the
+// last line doesn't need a trailing newline; the EOF is left for Parse to see.
+func (p *Parser) consumeEOL() bool {
+	tok, _ := p.scanIgnoreWhitespace()
+	if tok == EOF {
+		p.unscan()
+		return true
+	}
+	if tok != NEWLINE {
+		p.unscan()
+	}
+	return tok == NEWLINE
+}
+
 func (p *Parser) consumeComma() bool {
 	return p.consume(COMMA)
 }
 
 // Instruction parsing.
 func (p *Parser) parseInstruction(opcode string) (Assembled, error) {
+	loc := p.pos() // The mnemonic.
 	// Special case for PUSH, POP, LDMIA, STMIA, LDR and STR.
 	// They have their own rules for bracketing.
 	if opcode == "PUSH" || opcode == "POP" {
@@ -386,13 +1226,18 @@ func (p *Parser) parseInstruction(opcode string) (Assembled, error) {
 	if opcode == "LDR" || opcode == "STR" {
 		return p.parseLoadStore(opcode)
 	}
+	// Their operands wouldn't parse as an argument list, so catch eg. LDREQ
+	// here. The rest are caught at assembly time.
+	if base, cond, ok := splitCondition(opcode); ok && parsedMnemonics[base] {
+		return nil, fmt.Errorf("%s", conditionSuffixError(base, cond))
+	}
 
 	// Parsing regular instructions: comma-separated list of arguments.
 	args, err := p.parseArgList(opcode)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to parse argument list: %v", err)
 	}
-	return &Instruction{opcode, args, p.s.Location()}, nil
+	return &Instruction{opcode, args, loc}, nil
 }
 
 func (p *Parser) parseArgList(opcode string) ([]*Arg, error) {
@@ -412,6 +1257,8 @@ func (p *Parser) parseArgList(opcode string) ([]*Arg, error) {
 			if err == nil {
 				args = append(args, &Arg{kind: AT_LITERAL, lit: lit})
 				done = true
+			} else if isExprError(err) {
+				return nil, err
 			}
 		}
 
@@ -420,6 +1267,8 @@ func (p *Parser) parseArgList(opcode string) ([]*Arg, error) {
 			if err == nil {
 				args = append(args, &Arg{kind: AT_LABEL, label: expression})
 				done = true
+			} else if isExprError(err) {
+				return nil, err
 			}
 		}
 
@@ -429,7 +1278,16 @@ func (p *Parser) parseArgList(opcode string) ([]*Arg, error) {
 				args = append(args, &Arg{kind: AT_PC})
 			} else if t == SP {
 				args = append(args, &Arg{kind: AT_SP})
+			} else if t == LR {
+				args = append(args, &Arg{kind: AT_LR})
+			} else if (t == NEWLINE || t == EOF) && len(args) > 0 {
+				// After a comma, so there's an argument missing.
+				return nil, fmt.Errorf("Expected another argument after the last comma, but found %s", tokenNames[t])
 			} else if t == NEWLINE || t == EOF {
+				// No arguments at all.
+				if t == EOF {
+					p.unscan()
+				}
 				break
 			} else {
 				// Found something unexpected.
@@ -438,9 +1296,13 @@ func (p *Parser) parseArgList(opcode string) ([]*Arg, error) {
 			done = true
 		}
 
-		// Now we expect a comma or newline.
+		// Now we expect a comma or newline. A last line with no newline just
+		// ends at EOF, which is left for Parse to find.
 		t, _ := p.scanIgnoreWhitespace()
-		if t == NEWLINE || t == EOF {
+		if t == NEWLINE {
+			break
+		} else if t == EOF {
+			p.unscan()
 			break
 		} else if t != COMMA {
 			return nil, fmt.Errorf("Expected comma or end of arg list, but found %s", tokenNames[t])
@@ -454,8 +1316,15 @@ func (p *Parser) parsePushPop(opcode string) (Assembled, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Error parsing register list for %s: %v", opcode, err)
 	}
-	t, _ := p.scanIgnoreWhitespace()
-	if t != NEWLINE {
+	if regs == 0 && !lrpc {
+		extra := "PC"
+		if opcode == "PUSH" {
+			extra = "LR"
+		}
+		return nil, fmt.Errorf("%s has an empty register list, so it does nothing; it needs at least one register, or %s", opcode, extra)
+	}
+	if !p.consumeEOL() {
+		t, _ := p.scanIgnoreWhitespace()
 		return nil, fmt.Errorf("Unexpected %s at end of %s", tokenNames[t], opcode)
 	}
 	return &StackOp{regs, opcode == "PUSH", lrpc, 0xffff}, nil
@@ -466,6 +1335,11 @@ func (p *Parser) parseMultiStoreLoad(opcode string) (Assembled, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Failed to parse base register of %s: %v", opcode, err)
 	}
+	// ARM-style Rb! asks for write-back, but these always write back.
+	if t, lit := p.scan(); t == ILLEGAL && lit == "!" {
+		return nil, fmt.Errorf("%s always writes back to r%d, so the '!' is redundant; write %s r%d, {...}", opcode, base, opcode, base)
+	}
+	p.unscan()
 
 	if !p.consumeComma() {
 		t, _ := p.scanIgnoreWhitespace()
@@ -479,10 +1353,18 @@ func (p *Parser) parseMultiStoreLoad(opcode string) (Assembled, error) {
 	if lrpc {
 		return nil, fmt.Errorf("LR and PC not allowed in register list for %s", opcode)
 	}
+	if regs == 0 {
+		return nil, fmt.Errorf("%s has an empty register list, so it does nothing; it needs at least one register", opcode)
+	}
+	// The base register is always written back, so having it in the list too
+	// is ambiguous.
+	if regs&(1<<base) != 0 {
+		return nil, fmt.Errorf("Base register r%d can't also be in the register list for %s", base, opcode)
+	}
 
-	t, _ := p.scanIgnoreWhitespace()
-	if t != NEWLINE {
-		return nil, fmt.Errorf("Unexpected %s at end of line", tokenNames[t], opcode)
+	if !p.consumeEOL() {
+		t, _ := p.scanIgnoreWhitespace()
+		return nil, fmt.Errorf("Unexpected %s at end of %s", tokenNames[t], opcode)
 	}
 	return &StackOp{regs, opcode == "STMIA", false, base}, nil
 }
@@ -495,6 +1377,10 @@ func (p *Parser) parseReg() (uint16, error) {
 			return 0, fmt.Errorf("Failed to parse number in register: %s", lit)
 		}
 		return uint16(r), nil
+	} else if t == IDENT {
+		if r, ok := p.regAliases[lit]; ok {
+			return r, nil
+		}
 	}
 	p.unscan()
 	return 0, fmt.Errorf("Expected register, but found %s", tokenNames[t])
@@ -507,16 +1393,36 @@ func (p *Parser) parseRlist(opcode string, pclrAllowed bool) (uint16, bool, erro
 	if !p.consume(LBRACE) {
 		return 0, false, fmt.Errorf("Could not parse Rlist")
 	}
+	if p.consume(RBRACE) {
+		return 0, false, nil // Empty; the callers say why that's wrong.
+	}
 
-	// Now a comma-separated list of regs and PC or LR.
+	// Now a comma-separated list of regs, ranges like r0-r3, and PC or LR.
 	for {
 		t, _ := p.scanIgnoreWhitespace()
 		switch t {
-		case REGISTER:
+		case REGISTER, IDENT:
 			p.unscan()
 			r, err := p.parseReg()
-			if err == nil && 0 <= r && r < 8 {
-				regs = regs | (1 << uint(r))
+			if err != nil {
+				return 0, false, err
+			}
+			last := r
+			if t, _ := p.scanIgnoreWhitespace(); t == MINUS {
+				last, err = p.parseReg()
+				if err != nil {
+					return 0, false, fmt.Errorf("Bad end of register range r%d-: %v", r, err)
+				}
+				if last < r {
+					return 0, false, fmt.Errorf("Register range r%d-r%d is backwards; write it as r%d-r%d", r, last, last, r)
+				}
+			} else {
+				p.unscan()
+			}
+			for ; r <= last; r++ {
+				if r < 8 {
+					regs = regs | (1 << uint(r))
+				}
 			}
 		case PC:
 			if !pclrAllowed || opcode != "POP" {
@@ -525,7 +1431,7 @@ func (p *Parser) parseRlist(opcode string, pclrAllowed bool) (uint16, bool, erro
 			pclr = true
 		case LR:
 			if !pclrAllowed || opcode != "PUSH" {
-				return 0, false, fmt.Errorf("Found LR, but LR is only allowed on POP")
+				return 0, false, fmt.Errorf("Found LR, but LR is only allowed on PUSH")
 			}
 			pclr = true
 		}
@@ -542,10 +1448,58 @@ func (p *Parser) parseRlist(opcode string, pclrAllowed bool) (uint16, bool, erro
 }
 
 func (p *Parser) parseLiteral() (Expression, error) {
-	if !p.consume(HASH) {
-		return nil, fmt.Errorf("Failed to parse # for literal")
+	tok, lit := p.scanIgnoreWhitespace()
+	if tok == HASH {
+		if a, ok := p.parseAnnotation(); ok {
+			var err error
+			a.expr, err = p.parseSimpleExpr()
+			if err != nil {
+				return nil, err
+			}
+			return a, nil
+		}
+		return p.parseSimpleExpr()
+	}
+	p.unscan()
+	if tok == NUMBER || tok == IDENT {
+		// The classic mistake; say how to fix it.
+		return nil, fmt.Errorf("Expected a literal, but found '%s'; literals need a #, eg. #%s", lit, lit)
+	}
+	return nil, fmt.Errorf("Expected a # literal, but found %s", tokenNames[tok])
+}
+
+// parseAnnotation reads the s or u straight after the # of a signed or unsigned
+// literal, #s-3 or #u200, leaving the value to be read. Otherwise it reads
+// nothing, and returns false. A label called s or u followed by - or ( needs
+// brackets, #(s-3), and so does one like u200.
+func (p *Parser) parseAnnotation() (*Annotated, bool) {
+	tok, lit := p.scan()
+	pos := p.pos()
+	if tok != IDENT || (lit[0] != 's' && lit[0] != 'u') {
+		p.unscan()
+		return nil, false
 	}
-	return p.parseSimpleExpr()
+	a := &Annotated{signed: lit[0] == 's', loc: pos}
+	if rest := lit[1:]; rest != "" {
+		// The scanner reads #u200 as the identifier u200.
+		if rest[0] < '0' || rest[0] > '9' {
+			p.unscan()
+			return nil, false
+		}
+		if _, err := parseNumber(rest); err != nil {
+			p.unscan()
+			return nil, false
+		}
+		p.pushBack(Lexeme{NUMBER, rest, Position{pos.File, pos.Line, pos.Col + 1}})
+		return a, true
+	}
+	if next, _ := p.scan(); next != MINUS && next != NOT && next != LPAREN {
+		p.unscan()
+		p.pushBack(Lexeme{IDENT, lit, pos})
+		return nil, false
+	}
+	p.unscan()
+	return a, true
 }
 
 func (p *Parser) parseLoadStore(opcode string) (Assembled, error) {
@@ -594,7 +1548,7 @@ func (p *Parser) parseLoadStore(opcode string) (Assembled, error) {
 			t, _ = p.scanIgnoreWhitespace()
 			return nil, fmt.Errorf("Expected ] in %s, but found %s", opcode, tokenNames[t])
 		}
-		if !p.consume(NEWLINE) {
+		if !p.consumeEOL() {
 			t, _ = p.scanIgnoreWhitespace()
 			return nil, fmt.Errorf("Unexpected %s at end of %s", tokenNames[t], opcode)
 		}
@@ -613,9 +1567,10 @@ func (p *Parser) parseLoadStore(opcode string) (Assembled, error) {
 			// Try to parse a literal.
 			out.preLit, err = p.parseLiteral()
 			if err != nil {
+				litErr := err
 				out.preReg, err = p.parseReg()
 				if err != nil {
-					return nil, fmt.Errorf("Expected pre-indexed value, but failed to parse.")
+					return nil, fmt.Errorf("Expected a register or #offset after the base register: %v", litErr)
 				}
 			}
 
@@ -638,8 +1593,8 @@ func (p *Parser) parseLoadStore(opcode string) (Assembled, error) {
 			p.unscan()
 		}
 
-		t, _ = p.scanIgnoreWhitespace()
-		if t != NEWLINE {
+		if !p.consumeEOL() {
+			t, _ = p.scanIgnoreWhitespace()
 			return nil, fmt.Errorf("Unexpected %s at end of %s", tokenNames[t], opcode)
 		}
 
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDeepNesting(t *testing.T) {
+	// Each of these would otherwise recurse 10,000 levels deep in the parser.
+	for _, src := range []string{
+		".dat " + strings.Repeat("(", 10000) + "1" + strings.Repeat(")", 10000),
+		"  mov r0, #" + strings.Repeat("-(", 10000) + "1" + strings.Repeat(")", 10000),
+		".dat " + strings.Repeat("(", 10000),
+	} {
+		_, err := NewParser("deep.asm", strings.NewReader(src)).Parse()
+		if err == nil || !strings.Contains(err.Error(), "nesting too deep") {
+			t.Errorf("parsing %.20q...: got error %v, want nesting too deep", src, err)
+		}
+	}
+
+	// Up to the limit is fine, and one more is too many.
+	for depth, ok := range map[int]bool{defaultMaxDepth: true, defaultMaxDepth + 1: false} {
+		src := ".dat " + strings.Repeat("(", depth) + "1" + strings.Repeat(")", depth)
+		if _, err := NewParser("deep.asm", strings.NewReader(src)).Parse(); (err == nil) != ok {
+			t.Errorf("%d levels of brackets: got error %v", depth, err)
+		}
+	}
+
+	// -max-depth moves the limit either way.
+	for _, limit := range []int{2, 1000} {
+		for depth, ok := range map[int]bool{limit: true, limit + 1: false} {
+			src := ".dat " + strings.Repeat("(", depth) + "1" + strings.Repeat(")", depth)
+			p := NewParser("deep.asm", strings.NewReader(src))
+			p.maxDepth = limit
+			if _, err := p.Parse(); (err == nil) != ok {
+				t.Errorf("%d levels of brackets with a limit of %d: got error %v", depth, limit, err)
+			}
+		}
+	}
+}
+
+func TestNoTrailingNewline(t *testing.T) {
+	// The end of the file ends the last line, as a newline would.
+	tests := []struct {
+		src  string
+		want []uint16
+	}{
+		{"  mov r0, #5", []uint16{0x0805}},
+		{"  add r0, r1, r2", []uint16{0x8288}},
+		{"  ret ; done", []uint16{0x8003}},
+		{".dat 0x1234", []uint16{0x1234}},
+		{`.dat "ab"`, []uint16{0x61, 0x62}},
+		{".fill 7, 2", []uint16{7, 7}},
+		{":start .dat start + 1", []uint16{1}},
+		{".define x, 3\n.dat x", []uint16{3}},
+	}
+	for _, tc := range tests {
+		words, err := assembleWords(t, tc.src)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tc.src, err)
+		} else if fmt.Sprint(words) != fmt.Sprint(tc.want) {
+			t.Errorf("%q: got %04x, want %04x", tc.src, words, tc.want)
+		}
+	}
+
+	// A comma still needs something after it, even at the end of the file.
+	for _, src := range []string{"  add r0, r1,", "  add r0, r1, \t"} {
+		_, err := assembleWords(t, src)
+		if want := "Expected another argument after the last comma"; err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got error %v, want %s", src, err, want)
+		}
+	}
+}
+
+func TestLookahead(t *testing.T) {
+	newParser := func(src string) *Parser { return NewParser("test.asm", strings.NewReader(src)) }
+	expect := func(p *Parser, want ...tok) {
+		t.Helper()
+		for _, w := range want {
+			if tk, lit := p.scanIgnoreWhitespace(); (tok{tk, lit}) != w {
+				t.Errorf("got %s %q, want %s %q", tokenNames[tk], lit, tokenNames[w.t], w.lit)
+			}
+		}
+	}
+
+	// A failed consume after whitespace leaves the real token to read next.
+	p := newParser("   foo  ,bar")
+	if p.consume(COMMA) {
+		t.Errorf("consume(COMMA) before foo succeeded")
+	}
+	expect(p, tok{IDENT, "foo"})
+	if !p.consume(COMMA) {
+		t.Errorf("consume(COMMA) after foo failed")
+	}
+	expect(p, tok{IDENT, "bar"}, tok{EOF, ""})
+
+	// Tokens pushed back at the end of the file come before the EOF, which is
+	// still there after them.
+	p = newParser("a")
+	expect(p, tok{IDENT, "a"}, tok{EOF, ""})
+	p.unscan()
+	p.pushBack(Lexeme{IDENT, "x", Position{}}, Lexeme{EQUALS, "=", Position{}})
+	expect(p, tok{IDENT, "x"}, tok{EQUALS, "="}, tok{EOF, ""}, tok{EOF, ""})
+
+	// .FILL reads two tokens ahead for count= or value=, and puts them back
+	// when it's a name, even at the end of the file.
+	for src, want := range map[string]string{
+		".fill count":              ".FILL requires two arguments, found 1",
+		".fill value\n":            ".FILL requires two arguments, found 1",
+		".fill count, 3":           "Undefined label 'count'",
+		".fill count=1, value=2 x": "Unexpected identifier 'x' at end of FILL",
+	} {
+		_, _, err := AssembleBytes("test.asm", strings.NewReader(src), Options{}, binary.BigEndian)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got error %v, want %s", src, err, want)
+		}
+	}
+	words, err := assembleWords(t, ".define count, 2\n.fill count, 3")
+	if err != nil || fmt.Sprint(words) != "[2 2 2]" {
+		t.Errorf(".fill count, 3 with count 2: got %v, want [2 2 2]; error %v", words, err)
+	}
+}
+
+func TestHexString(t *testing.T) {
+	tests := []struct {
+		src  string
+		want []uint16
+	}{
+		{`.dat x"1234"`, []uint16{0x1234}},
+		{".endian little\n" + `.dat x"1234"`, []uint16{0x3412}},
+		{`.dat x"123456"`, []uint16{0x1234, 0x5600}},
+		{".endian little\n" + `.dat x"123456"`, []uint16{0x3412, 0x0056}},
+		{`.byte x"12", x"34"`, []uint16{0x1234}},
+		{".endian little\n" + `.byte x"1234"`, []uint16{0x3412}},
+	}
+	for _, tc := range tests {
+		words, err := assembleWords(t, tc.src)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tc.src, err)
+		} else if fmt.Sprint(words) != fmt.Sprint(tc.want) {
+			t.Errorf("%q: got %04x, want %04x", tc.src, words, tc.want)
+		}
+	}
+
+	for _, src := range []string{`.dat x"123"`, `.dat x"12G4"`} {
+		if _, err := assembleWords(t, src); err == nil {
+			t.Errorf("%q: assembled without an error", src)
+		}
+	}
+}
+
+func TestParseConstant(t *testing.T) {
+	tests := []struct {
+		text string
+		want uint16
+		err  string
+	}{
+		{text: "0xffff", want: 0xffff},
+		{text: "-1", want: 0xffff},
+		{text: "(1 << 16) >> 4", want: 0x1000},
+		{text: "0x10000", err: "Value 65536 (0x10000) doesn't fit in 16 bits"},
+		{text: "-0x10000", err: "Value -65536 (-0x10000) doesn't fit in 16 bits"},
+		{text: "1 / 0", err: "Division by zero"},
+		{text: "foo", err: "'foo' must be a constant"},
+	}
+	for _, tc := range tests {
+		got, err := parseConstant(tc.text)
+		switch {
+		case tc.err != "":
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%q: got %#x, error %v; want %q", tc.text, got, err, tc.err)
+			}
+		case err != nil || got != tc.want:
+			t.Errorf("%q: got %#x, error %v; want %#x", tc.text, got, err, tc.want)
+		}
+	}
+}
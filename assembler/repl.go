@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+var (
+	replFlags = flag.NewFlagSet("repl", flag.ExitOnError)
+	replOrg   = replFlags.String("org", "0", "Address each instruction is assembled at, which decides branch offsets")
+)
+
+// replFile is the file name for positions in the REPL's errors.
+const replFile = "<stdin>"
+
+// runRepl reads instructions from stdin a line at a time, and prints the words
+// each assembles to and the encoder that handled it, for trying out the ISA.
+// Errors are printed and the REPL carries on.
+func runRepl(args []string) {
+	origin, err := parseConstant(*replOrg)
+	if err != nil {
+		fmt.Printf("Error: bad -org: %v\n", err)
+		os.Exit(1)
+	}
+	in := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("> ")
+		if !in.Scan() {
+			fmt.Println()
+			return
+		}
+		if line := strings.TrimSpace(in.Text()); line != "" {
+			replLine(os.Stdout, line, origin)
+		}
+	}
+}
+
+// replLine assembles line, a single instruction, on its own at origin. There
+// are no labels, so a branch target has to be an address.
+func replLine(w io.Writer, line string, origin uint16) {
+	ast, err := NewParser(replFile, strings.NewReader(line)).Parse()
+	if err != nil {
+		replError(w, line, err)
+		return
+	}
+	if len(ast.Lines) != 1 {
+		fmt.Fprintln(w, "Error: expected a single instruction")
+		return
+	}
+	// Only ordinary instructions go through an encoder; loads, stores and the
+	// multiple forms have a format each.
+	var format string
+	switch ast.Lines[0].(type) {
+	case *Instruction:
+	case *LoadStore:
+		format = "memory-access format"
+	case *StackOp:
+		format = "multiple load/store format"
+	default:
+		fmt.Fprintln(w, "Error: only instructions can be assembled here, not labels or directives")
+		return
+	}
+	for _, u := range ast.LabelUses {
+		if u.label != buildIDSymbol {
+			replError(w, line, &Error{u.loc, fmt.Sprintf("There are no labels here, so '%s' isn't defined; use an address, eg. 0x20", u.label)})
+			return
+		}
+	}
+
+	s, err := assemble(ast, Options{Origin: origin, RecordEncodings: true})
+	if err != nil {
+		replError(w, line, err)
+		return
+	}
+	for _, wn := range s.warnings {
+		fmt.Fprintf(w, "Warning: %s\n", wn.Msg)
+	}
+	if ei, ok := s.encodings[origin]; ok {
+		format = ei.Encoder + " encoder"
+	}
+	var words []string
+	for a := origin; a != s.index; a++ {
+		words = append(words, fmt.Sprintf("%04x", s.rom[a]))
+	}
+	fmt.Fprintf(w, "%s    %s\n", strings.Join(words, " "), format)
+}
+
+// replError prints err, pointing at the column in line if it has one.
+func replError(w io.Writer, line string, err error) {
+	errs, ok := err.(ErrorList)
+	if !ok {
+		e, isError := err.(*Error)
+		if !isError {
+			fmt.Fprintf(w, "Error: %v\n", err)
+			return
+		}
+		errs = ErrorList{e}
+	}
+	for _, e := range errs {
+		fmt.Fprintf(w, "Error: %s\n", e.Msg)
+		if e.Pos.Line == 1 && e.Pos.Col > 0 {
+			fmt.Fprintf(w, "  %s\n  %*s\n", line, e.Pos.Col, "^")
+		}
+	}
+}
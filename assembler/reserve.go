@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// addrRange is an inclusive range of addresses, eg. for -reserve.
+type addrRange struct{ lo, hi uint16 }
+
+func (r addrRange) String() string { return fmt.Sprintf("0x%04x-0x%04x", r.lo, r.hi) }
+
+func (r addrRange) contains(a uint16) bool { return r.lo <= a && a <= r.hi }
+
+// rangeList collects the ranges given to a repeatable flag like -reserve.
+type rangeList []addrRange
+
+func (l *rangeList) String() string {
+	parts := make([]string, len(*l))
+	for i, r := range *l {
+		parts[i] = r.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+func (l *rangeList) Set(text string) error {
+	r, err := parseAddrRange(text)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, r)
+	return nil
+}
+
+// parseAddrRange parses LO-HI, where each end is a constant expression. A
+// single address is a range of one word.
+func parseAddrRange(text string) (addrRange, error) {
+	lo, hi, ok := strings.Cut(text, "-")
+	if !ok {
+		hi = lo
+	}
+	l, err := parseConstant(strings.TrimSpace(lo))
+	if err != nil {
+		return addrRange{}, err
+	}
+	h, err := parseConstant(strings.TrimSpace(hi))
+	if err != nil {
+		return addrRange{}, err
+	}
+	if h < l {
+		return addrRange{}, fmt.Errorf("range %s is backwards", text)
+	}
+	return addrRange{l, h}, nil
+}
+
+// checkReserved records an error in s.reservedWrites if l, which assembled
+// from start up to the current index, wrote into any of the Options.Reserved
+// ranges. Only the first offending address is named.
+func checkReserved(s *AssemblyState, l Assembled, start uint16, loc Position) {
+	if _, ok := l.(*Org); ok {
+		return // Moves the index without writing anything.
+	}
+	for a := start; a < s.index; a++ {
+		if !s.used[a] {
+			continue // Skipped by .RESERVE, not written.
+		}
+		for _, r := range s.opts.Reserved {
+			if r.contains(a) {
+				s.reservedWrites = append(s.reservedWrites, &Error{loc,
+					fmt.Sprintf("Writes to address 0x%04x, in the reserved range %s", a, r)})
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// writeSizes prints how many words each label covers: from its address up to
+// the next label, or to the end of its run of written words if that comes
+// first. Labels at the same address share a row. Words before the first label
+// in a run are counted as (unlabelled).
+func writeSizes(w io.Writer, s *AssemblyState) {
+	type size struct {
+		name  string
+		addr  uint16
+		words int
+	}
+
+	byAddr := make(map[uint16][]string)
+	for name, lr := range s.labels {
+		if !strings.HasPrefix(name, "@") { // Anonymous labels have no name.
+			byAddr[lr.value] = append(byAddr[lr.value], name)
+		}
+	}
+	addrs := make([]int, 0, len(byAddr))
+	for a := range byAddr {
+		addrs = append(addrs, int(a))
+	}
+	sort.Ints(addrs)
+
+	var sizes []*size
+	unlabelled := &size{name: "(unlabelled)"}
+	total := 0
+	next := 0 // Index into addrs of the first label not yet reached.
+	for _, seg := range segments(s) {
+		start, end := int(seg.Origin), int(seg.Origin)+len(seg.Words)
+		total += len(seg.Words)
+		for next < len(addrs) && addrs[next] < start {
+			next++
+		}
+		if next == len(addrs) || addrs[next] > start {
+			stop := end
+			if next < len(addrs) && addrs[next] < end {
+				stop = addrs[next]
+			}
+			unlabelled.words += stop - start
+		}
+		for ; next < len(addrs) && addrs[next] < end; next++ {
+			stop := end
+			if next+1 < len(addrs) && addrs[next+1] < end {
+				stop = addrs[next+1]
+			}
+			names := byAddr[uint16(addrs[next])]
+			sort.Strings(names)
+			sizes = append(sizes, &size{strings.Join(names, ", "), uint16(addrs[next]), stop - addrs[next]})
+		}
+	}
+	if unlabelled.words > 0 {
+		sizes = append(sizes, unlabelled)
+	}
+	// Biggest first, as for -stats.
+	sort.SliceStable(sizes, func(i, j int) bool {
+		if sizes[i].words != sizes[j].words {
+			return sizes[i].words > sizes[j].words
+		}
+		return sizes[i].addr < sizes[j].addr
+	})
+
+	for _, sz := range sizes {
+		fmt.Fprintf(w, "%s: %d words\n", sz.name, sz.words)
+	}
+	fmt.Fprintf(w, "Total: %d words\n", total)
+}
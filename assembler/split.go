@@ -0,0 +1,28 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// writeSplit writes each segment of the program, each run of consecutive words,
+// to its own big-endian file named after its origin: prefix.0x8000.bin. The
+// files are listed in prefix.manifest, one per line as the origin and length
+// in words, in hex, and the file name.
+func writeSplit(prefix string, s *AssemblyState) error {
+	var manifest strings.Builder
+	for _, seg := range segments(s) {
+		name := fmt.Sprintf("%s.0x%04x.bin", prefix, seg.Origin)
+		buf := make([]byte, 2*len(seg.Words))
+		for i, w := range seg.Words {
+			binary.BigEndian.PutUint16(buf[2*i:], w)
+		}
+		if err := os.WriteFile(name, buf, 0644); err != nil {
+			return err
+		}
+		fmt.Fprintf(&manifest, "%04x %04x %s\n", seg.Origin, len(seg.Words), name)
+	}
+	return os.WriteFile(prefix+".manifest", []byte(manifest.String()), 0644)
+}
@@ -7,6 +7,68 @@ type LabelRef struct {
 	defined bool
 }
 
+// Options control how a program is assembled.
+type Options struct {
+	// Where each pass starts assembling, until a .ORG says otherwise.
+	Origin uint16
+	// Report out-of-range MOV immediates as errors, rather than rewriting them
+	// as NEG or MOV+MVH.
+	NoOpCollapse bool
+	// Warn about .DAT values that don't fit in 16 bits.
+	WarnTruncate bool
+	// Record which encoder handled each instruction, in traces.
+	TraceEncoding bool
+	// Record each instruction's operands and encoding, in encodings.
+	RecordEncodings bool
+	// Symbols defined before assembly starts, as if by .DEFINE. The source can
+	// still redefine them.
+	Defines map[string]uint16
+	// Skip over lines with errors instead of stopping at the first one, so the
+	// rest of the program is still assembled and every error is reported.
+	KeepGoing bool
+	// Warn about labels and .DEFINEs that nothing refers to.
+	WarnUnused bool
+	// Warn about gaps of more than this many words between the parts of the
+	// output that are written, which get padded out in the binary. 0 for none.
+	WarnGap int
+	// Warn about names that are both a label and a define. The label always
+	// wins, so the define is never used.
+	WarnShadow bool
+	// Warn when a .DEFINE changes the value of one earlier in the program.
+	WarnRedefine bool
+	// Warn about lines indented with both tabs and spaces.
+	WarnIndent bool
+	// Warn about characters in strings outside these ranges, if any are set.
+	Charset charset
+	// The program's entry point, which counts as used even if nothing in the
+	// program refers to it.
+	Entry string
+	// Address ranges nothing may be written to, eg. vectors or an MMIO window.
+	Reserved []addrRange
+	// The filler for gaps in the output, and for .ALIGN until a .PADVALUE
+	// changes it.
+	PadValue uint16
+	// Label and define values from a previous assembly of the same program,
+	// to start from instead of 0. See cache.go.
+	Cache *symbolCache
+	// The value of __BUILD_ID__, for baking a build number into the program.
+	BuildID uint16
+	// Grow the ROM as it's written, instead of allocating all 64K words up
+	// front. That's a lot less memory for small programs, at the cost of some
+	// copying as the ROM grows.
+	CompactROM bool
+	// Treat names that aren't defined anywhere as external symbols, to be
+	// resolved by a linker, instead of errors. See object.go.
+	Externals bool
+	// Keep the label and define values from the start of each pass, so that
+	// writeSymbolDump can show which ones moved.
+	KeepPrevious bool
+}
+
+// buildIDSymbol is always defined, as Options.BuildID. There's deliberately no
+// date or time equivalent, so that builds are reproducible.
+const buildIDSymbol = "__BUILD_ID__"
+
 // AssemblyState tracks the state of the assembly so far.
 type AssemblyState struct {
 	// Fixed labels in the code, defined with :label.
@@ -15,17 +77,95 @@ type AssemblyState struct {
 	// set to null initially.
 	labels map[string]*LabelRef
 
-	// Updateable defines.
+	// Updateable defines. These keep their values from one pass to the next,
+	// but are only defined once the pass reaches their .DEFINE.
 	symbols map[string]*LabelRef
+	// Defines used before their .DEFINE on this pass, and the values used.
+	early map[string]uint16
+	// The names assigned with .SET. Their value depends on where they're
+	// used, so one used before its first .SET is an error rather than early.
+	variables map[string]bool
+	// Where each define was last defined on this pass, for
+	// Options.WarnRedefine.
+	definedAt map[string]Position
+	// Every label or define that's been looked up, on any pass.
+	referenced map[string]bool
+	// How many times a label that hasn't been placed yet, or a define before
+	// its first .DEFINE on the first pass, was looked up. Those evaluate to 0
+	// for now, so range checks compare the count before and after to tell
+	// when to wait for the next pass.
+	unplaced int
+
+	// The pass being assembled, from 1; 0 if it stopped before the first.
+	pass int
+	// With Options.KeepPrevious, the label and define values from the start of
+	// the latest pass.
+	prevLabels  map[string]uint16
+	prevSymbols map[string]uint16
 
 	// True when all labels are resolved, false otherwise.
 	resolved bool
 	// True when something has changed this pass (eg. a label's value).
 	dirty bool
 
-	rom   [65536]uint16
+	// All 64K words, or with Options.CompactROM only up to the highest address
+	// written so far.
+	rom   []uint16
 	index uint16
 	used  map[uint16]bool
+	// Set when the index has run off the end of memory and wrapped round to
+	// 0. Writing anything more is an error, until an .ORG moves it.
+	wrapped bool
+	// The line being assembled, for errors that come from below the AST, like
+	// a write over earlier code.
+	line Position
+
+	opts Options
+
+	// True when .ENDIAN LITTLE is in effect, for packing bytes into words.
+	// Each pass starts out big-endian.
+	littleEndian bool
+	// The filler for .ALIGN, set by .PADVALUE. Each pass starts out with
+	// Options.PadValue.
+	padValue uint16
+
+	// Warnings raised so far, and the locations that raised them. Assembly
+	// takes several passes, and each warning should only be reported once.
+	warnings ErrorList
+	warned   map[Position]bool
+
+	// With Options.TraceEncoding, a line for each instruction assembled on the
+	// latest pass.
+	traces []string
+	// With Options.RecordEncodings, the instructions assembled on the latest
+	// pass, by address.
+	encodings map[uint16]*EncodedInstruction
+
+	// The .ASSERTs that failed on the latest pass.
+	failedAsserts ErrorList
+	// Lines that wrote into an Options.Reserved range on the latest pass.
+	reservedWrites ErrorList
+	// With Options.KeepGoing, the errors from the latest pass.
+	errors ErrorList
+
+	// With Options.Externals, the names that aren't defined in the program.
+	// They evaluate to externalValue, and each use is noted in externalUses
+	// until something that can record a relocation claims it.
+	externals     map[string]bool
+	externalValue uint16
+	externalUses  []*LabelUse
+	// The relocations recorded on the latest pass.
+	relocations []Relocation
+	// Where each .ORG and .RESERVE on the latest pass moved the index to, for
+	// Options.WarnGap.
+	jumps []jump
+}
+
+// jump is a move of the index by .ORG or .RESERVE, and the expression that
+// caused it.
+type jump struct {
+	to  uint16
+	loc Position
 }
 
 func (s *AssemblyState) lookup(key string) (uint16, bool, bool) {
@@ -55,22 +195,106 @@ func (s *AssemblyState) updateLabel(l string, loc uint16) {
 }
 
 func (s *AssemblyState) updateSymbol(l string, val uint16) {
+	if lr, ok := s.symbols[l]; ok {
+		lr.value = val
+		lr.defined = true
+		return
+	}
 	s.symbols[l] = &LabelRef{val, true}
 }
 
+// warn records a warning for loc, unless one was already recorded on an
+// earlier pass.
+func (s *AssemblyState) warn(loc Position, msg string, args ...interface{}) {
+	if s.warned == nil {
+		s.warned = make(map[Position]bool)
+	}
+	if s.warned[loc] {
+		return
+	}
+	s.warned[loc] = true
+	s.warnings = append(s.warnings, &Error{loc, fmt.Sprintf(msg, args...)})
+}
+
+// reset prepares for another pass. The maps are cleared rather than
+// reallocated, so repeated passes don't churn the allocator.
 func (s *AssemblyState) reset() {
-	s.symbols = make(map[string]*LabelRef)
+	if s.symbols == nil {
+		if !s.opts.CompactROM {
+			s.rom = make([]uint16, 0x10000)
+		}
+		s.symbols = make(map[string]*LabelRef)
+		s.early = make(map[string]uint16)
+		s.definedAt = make(map[string]Position)
+		s.referenced = make(map[string]bool)
+		s.used = make(map[uint16]bool)
+	} else {
+		for _, lr := range s.symbols {
+			lr.defined = false
+		}
+		clear(s.early)
+		clear(s.definedAt)
+		clear(s.used)
+	}
+	s.symbols[buildIDSymbol] = &LabelRef{s.opts.BuildID, true}
+	for name, value := range s.opts.Defines {
+		s.symbols[name] = &LabelRef{value, true}
+	}
 	s.resolved = true
 	s.dirty = false
-	s.index = 0
-	s.used = make(map[uint16]bool)
+	s.index = s.opts.Origin
+	s.wrapped = false
+	s.traces = s.traces[:0]
+	if s.opts.RecordEncodings {
+		s.encodings = make(map[uint16]*EncodedInstruction)
+	}
+	s.failedAsserts = s.failedAsserts[:0]
+	s.reservedWrites = s.reservedWrites[:0]
+	s.relocations = s.relocations[:0]
+	s.jumps = s.jumps[:0]
+	s.littleEndian = false
+	s.padValue = s.opts.PadValue
+}
+
+// size returns the size of the program in words: one past the highest address
+// written.
+func (s *AssemblyState) size() int {
+	size := 0
+	for a := range s.used {
+		if int(a)+1 > size {
+			size = int(a) + 1
+		}
+	}
+	return size
+}
+
+// pushBytes packs bytes two to a word, padding an odd final byte with 0. When
+// little is set, the first byte of each pair goes in the low half.
+func (s *AssemblyState) pushBytes(bytes []byte, little bool) {
+	for i := 0; i < len(bytes); i += 2 {
+		hi, lo := uint16(bytes[i]), uint16(0)
+		if i+1 < len(bytes) {
+			lo = uint16(bytes[i+1])
+		}
+		if little {
+			hi, lo = lo, hi
+		}
+		s.push(hi<<8 | lo)
+	}
 }
 
 func (s *AssemblyState) push(x uint16) {
+	if s.wrapped {
+		asmError(s.line, "Runs past the end of memory at 0xffff")
+	}
 	if s.used[s.index] {
-		panic(fmt.Sprintf("overlapping regions at $%04x", s.index))
+		asmError(s.line, "Overlaps earlier code or data at 0x%04x; check the .ORGs", s.index)
 	}
 	s.used[s.index] = true
+	if int(s.index) >= len(s.rom) {
+		s.rom = append(s.rom, make([]uint16, int(s.index)+1-len(s.rom))...)
+	}
 	s.rom[s.index] = x
 	s.index++
+	s.wrapped = s.index == 0
 }
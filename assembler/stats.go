@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+)
+
+// writeStats runs one more pass over an already-assembled program, counting
+// how often each mnemonic is used and how many words it accounts for. Words
+// from directives (.DAT, .FILL and friends) are lumped together as data.
+func writeStats(w io.Writer, ast *AST, s *AssemblyState) {
+	type stat struct {
+		name  string
+		count int
+		words int
+	}
+	stats := make(map[string]*stat)
+	data := &stat{name: "(data)"}
+	total := 0
+
+	s.reset()
+	for _, l := range ast.Lines {
+		start := s.index
+		l.Assemble(s)
+		words := int(s.index - start)
+		switch l.(type) {
+		case *Org, *Reserve:
+			// Neither writes anything.
+			continue
+		}
+		total += words
+
+		st := data
+		if inst, ok := l.(*Instruction); ok {
+			st = stats[inst.opcode]
+			if st == nil {
+				st = &stat{name: inst.opcode}
+				stats[inst.opcode] = st
+			}
+			st.count++
+		} else if words == 0 {
+			continue
+		} else {
+			st.count++
+		}
+		st.words += words
+	}
+
+	sorted := make([]*stat, 0, len(stats)+1)
+	for _, st := range stats {
+		sorted = append(sorted, st)
+	}
+	if data.count > 0 {
+		sorted = append(sorted, data)
+	}
+	// Biggest first, since the point is finding where the space goes.
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].words != sorted[j].words {
+			return sorted[i].words > sorted[j].words
+		}
+		return sorted[i].name < sorted[j].name
+	})
+
+	fmt.Fprintf(w, "%-8s %6s %6s %6s\n", "Mnemonic", "Count", "Words", "%")
+	for _, st := range sorted {
+		pct := 0.0
+		if total > 0 {
+			pct = 100 * float64(st.words) / float64(total)
+		}
+		fmt.Fprintf(w, "%-8s %6d %6d %5.1f%%\n", st.name, st.count, st.words, pct)
+	}
+	fmt.Fprintf(w, "%-8s %6s %6d\n", "Total", "", total)
+}
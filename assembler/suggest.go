@@ -0,0 +1,53 @@
+package main
+
+// directives lists every directive parseDirective knows, and the conditionals,
+// for suggesting one when there's a typo.
+var directives = []string{"ALIGN", "ASSERT", "BYTE", "CONST", "DAT", "DEFINE", "DEFINEREG",
+	"ELSE", "ENDIAN", "ENDIF", "ERROR", "FILL", "IFDEF", "IFNDEF", "INCBIN", "INCLUDE",
+	"OPCODE", "ORG", "PADVALUE", "RESERVE", "SET", "STRINGS", "WARNING", "WORD"}
+
+// closestName returns the candidate nearest to name by edit distance, or "" if
+// none is close enough to be a likely typo: one edit away, or two for names of
+// four or more letters. Ties go to the earliest candidate.
+func closestName(name string, candidates []string) string {
+	limit := 1
+	if len(name) >= 4 {
+		limit = 2
+	}
+	best, bestDist := "", limit+1
+	for _, c := range candidates {
+		if d := editDistance(name, c); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+// editDistance is the Levenshtein distance between a and b: the number of
+// single character insertions, deletions and substitutions to get from one to
+// the other.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost         // Substitute.
+			if d := prev[j] + 1; d < cur[j] { // Delete.
+				cur[j] = d
+			}
+			if d := cur[j-1] + 1; d < cur[j] { // Insert.
+				cur[j] = d
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// writeSymbolDump prints every label and define with its value and whether
+// it's defined, for -dump-symbols-on-error. A value that changed during the
+// latest pass also shows what it was before, which picks out the labels that
+// are still moving when the passes don't settle.
+func writeSymbolDump(w io.Writer, s *AssemblyState) {
+	if s.pass == 0 {
+		fmt.Fprintln(w, "Symbols before the first pass:")
+	} else {
+		fmt.Fprintf(w, "Symbols on pass %d:\n", s.pass)
+	}
+	dump := func(kind string, refs map[string]*LabelRef, prev map[string]uint16) {
+		for _, name := range sortedKeys(refs) {
+			lr := refs[name]
+			state := "defined"
+			if !lr.defined {
+				state = "undefined"
+			}
+			line := fmt.Sprintf("  %-6s %-20s 0x%04x  %s", kind, name, lr.value, state)
+			if old, ok := prev[name]; ok && old != lr.value {
+				line += fmt.Sprintf(", was 0x%04x", old)
+			}
+			fmt.Fprintln(w, line)
+		}
+	}
+	dump("label", s.labels, s.prevLabels)
+	dump("define", s.symbols, s.prevSymbols)
+}
+
+// symbolValues copies the values out of refs.
+func symbolValues(refs map[string]*LabelRef) map[string]uint16 {
+	values := make(map[string]uint16, len(refs))
+	for name, lr := range refs {
+		values[name] = lr.value
+	}
+	return values
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// textCase is how fmt, disasm and -listing write mnemonics, directive names and
+// registers, from -case. Nothing else in a line changes: labels, numbers,
+// strings and comments are left alone.
+type textCase int
+
+const (
+	caseKeep  textCase = iota // As written, or as disasm makes them.
+	caseUpper                 // ADD R0, SP, #4
+	caseLower                 // add r0, sp, #4
+)
+
+func (c *textCase) String() string {
+	return [...]string{"keep", "upper", "lower"}[*c]
+}
+
+func (c *textCase) Set(text string) error {
+	switch text {
+	case "keep":
+		*c = caseKeep
+	case "upper":
+		*c = caseUpper
+	case "lower":
+		*c = caseLower
+	default:
+		return fmt.Errorf("expected keep, upper or lower")
+	}
+	return nil
+}
+
+// applyCase recases the mnemonic or directive name and the registers in code,
+// a line of source without its comment. A label in front of an instruction
+// keeps its case.
+func applyCase(code string, c textCase) string {
+	if c == caseKeep {
+		return code
+	}
+	convert := strings.ToUpper
+	if c == caseLower {
+		convert = strings.ToLower
+	}
+
+	runes := []rune(code)
+	recase := func(l Lexeme) {
+		start := l.Pos.Col - 1
+		copy(runes[start:], []rune(convert(l.Lit)))
+	}
+
+	toks := NewScanner("", strings.NewReader(code)).Tokens()
+	atStart := true // Still looking for the mnemonic or directive.
+	for i := 0; i < len(toks); i++ {
+		switch t := toks[i]; {
+		case t.Token == WS:
+		case t.Token == REGISTER || t.Token == PC || t.Token == SP || t.Token == LR:
+			recase(t)
+		case !atStart:
+		case t.Token == COLON:
+			if i+1 < len(toks) && toks[i+1].Token == IDENT {
+				i++ // A label, not a mnemonic.
+			}
+		case t.Token == DOT:
+			if i+1 < len(toks) && toks[i+1].Token == IDENT {
+				i++
+				recase(toks[i])
+			}
+			atStart = false
+		case t.Token == IDENT:
+			recase(t)
+			atStart = false
+		default:
+			atStart = false
+		}
+	}
+	return string(runes)
+}
@@ -0,0 +1,3 @@
+module github.com/bshepherdson/risque16
+
+go 1.22
@@ -0,0 +1,14 @@
+; A bare : is an anonymous label. 1b branches to the last one before the
+; branch, 1f to the next one after it, and 2b and 2f one further.
+  mov r0, #10
+:
+  sub r0, #1
+  bne 1b               ; Loops back to the sub.
+  beq 1f               ; Skips the brk.
+  brk
+:
+  b 2f                 ; Past the next one, to the ret.
+:
+  b 2b                 ; Back two, to the b 2f.
+:
+  ret
@@ -0,0 +1,26 @@
+#!/bin/sh
+# Times the parser on a large generated program, with assemble -parse-only.
+# The optional argument is how many copies of the loop body to generate
+# (default 20000, which is 160000 lines).
+dir=$(cd "$(dirname "$0")" && pwd)
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+
+(cd "$dir/../assembler" && go build -o "$tmp/assembler" *.go) || exit 1
+
+awk -v n="${1:-20000}" 'BEGIN {
+	for (i = 0; i < n; i++) {
+		printf ":loop%d   ; iteration %d\n", i, i
+		printf "  mov r%d, #0x%x\n", i % 8, i % 256
+		printf "  add r1, r2, r3\n"
+		printf "  ldr r0, [r1, #%d]\n", i % 16
+		printf "  str r0, [sp, #%d + 1]\n", i % 100
+		printf "  cmp r0, #%d\n", i % 200
+		printf "  bne loop%d\n", i
+		printf "  .dat 0x1234, %d, loop%d + 1\n", i, i
+	}
+}' >"$tmp/big.asm"
+
+for run in 1 2 3; do
+	"$tmp/assembler" assemble -parse-only "$tmp/big.asm" || exit 1
+done
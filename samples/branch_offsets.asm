@@ -0,0 +1,17 @@
+; Branch offsets are relative to the next instruction, so a branch to the next
+; instruction is offset 0. Offset -1 would be a branch to itself, but that marks
+; the long form, so a self-branch takes the long form instead. Short branches
+; reach 255 words forward and 256 back.
+:self
+  b self
+  b next
+:next
+  b self
+  bne back_limit
+  beq fwd_limit
+:back_limit
+  .reserve 255
+:fwd_limit
+  b back_limit
+  b self
+:here b here
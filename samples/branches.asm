@@ -0,0 +1,12 @@
+; Short branches reach 256 words either way; anything further takes the
+; long form, with the target in a second word.
+:top
+  beq near
+  bne far
+:near
+  b top
+  bl near
+  .reserve 0x200
+:far
+  b top
+  bl far
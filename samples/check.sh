@@ -0,0 +1,64 @@
+#!/bin/sh
+# Assembles each sample program and compares the result with its golden .bin
+# (or .out directory). With -update, rewrites those instead. Exits 1 if any sample fails.
+dir=$(cd "$(dirname "$0")" && pwd)
+tmp=$(mktemp -d)
+trap 'rm -rf "$tmp"' EXIT
+
+(cd "$dir/../assembler" && go build -o "$tmp/assembler" *.go) || exit 1
+
+status=0
+for src in "$dir"/*.asm; do
+	name=$(basename "$src" .asm)
+	# A first line "; flags: FLAGS" passes FLAGS to the assembler, and every
+	# file it writes is compared with the golden copies in the name.out directory.
+	flags=$(head -n 1 "$src" | sed -n 's/^; flags: //p')
+	rm -rf "$tmp/run" && mkdir "$tmp/run"
+	if ! (cd "$tmp/run" && ../assembler assemble $flags "$src" >"$tmp/log" 2>/dev/null); then
+		echo "FAIL $name: didn't assemble"
+		cat "$tmp/log"
+		status=1
+	elif [ -n "$flags" ]; then
+		if [ "$1" = "-update" ]; then
+			rm -rf "$dir/$name.out" && cp -R "$tmp/run" "$dir/$name.out"
+			echo "updated $name.out"
+		elif diff -r -q "$tmp/run" "$dir/$name.out" >/dev/null; then
+			echo "ok   $name"
+		else
+			echo "FAIL $name: output differs from $name.out"
+			status=1
+		fi
+	elif [ "$1" = "-update" ]; then
+		cp "$tmp/run/out.bin" "$dir/$name.bin"
+		echo "updated $name.bin"
+	elif cmp -s "$tmp/run/out.bin" "$dir/$name.bin"; then
+		echo "ok   $name"
+	else
+		echo "FAIL $name: output differs from $name.bin"
+		status=1
+	fi
+done
+
+# Each of errors/*.asm must fail, with an error containing the text on its
+# first line, which is "; error: TEXT". A second line "; flags: FLAGS" passes
+# FLAGS to the assembler.
+for src in "$dir"/errors/*.asm; do
+	name=errors/$(basename "$src" .asm)
+	want=$(head -n 1 "$src" | sed -n 's/^; error: //p')
+	flags=$(sed -n '2s/^; flags: //p' "$src")
+	if [ -z "$want" ]; then
+		echo "FAIL $name: first line isn't '; error: TEXT'"
+		status=1
+	elif (cd "$tmp" && ./assembler assemble $flags "$src" >"$tmp/log" 2>/dev/null); then
+		echo "FAIL $name: assembled, but should have failed"
+		status=1
+	elif grep -qF -- "$want" "$tmp/log"; then
+		echo "ok   $name"
+	else
+		echo "FAIL $name: error doesn't mention '$want'"
+		cat "$tmp/log"
+		status=1
+	fi
+	rm -f "$tmp/out.bin"
+done
+exit $status
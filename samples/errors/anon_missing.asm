@@ -0,0 +1,5 @@
+; error: No anonymous label for 1f; there are only 0 after it
+; A forward reference needs an anonymous label after it to go to.
+:
+  b 1b
+  b 1f
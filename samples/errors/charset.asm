@@ -0,0 +1,4 @@
+; error: String has characters outside the -charset 0x0000-0x007f: 'é' (U+00E9)
+; flags: -charset ascii -Werror
+; A font with only 7-bit ASCII has no é, so -charset ascii catches it.
+.dat "café", 0
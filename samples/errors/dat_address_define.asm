@@ -0,0 +1,4 @@
+; error: 'start' is not a label, so =start has no address
+; =name is only for labels; a .define has a value, but no address.
+.define start, 4
+.dat =start
@@ -0,0 +1,9 @@
+; error: already has an .ELSE
+; An .IFNDEF can only have one .ELSE.
+.ifndef DEBUG
+  .dat 1
+.else
+  .dat 2
+.else
+  .dat 3
+.endif
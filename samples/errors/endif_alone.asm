@@ -0,0 +1,4 @@
+; error: .ENDIF without an .IFDEF or .IFNDEF in the same file
+; An .ENDIF has to close something.
+  mov r0, #1
+.endif
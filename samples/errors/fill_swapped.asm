@@ -0,0 +1,4 @@
+; error: .FILL of 65535 words runs past the end of memory. (The order is .FILL value, count; are they swapped?)
+; The value comes first, so this is 0xffff copies of 4, not 4 copies of 0xffff.
+.org 0xfffe
+  .fill 4, 0xffff
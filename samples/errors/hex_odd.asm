@@ -0,0 +1,3 @@
+; error: odd number of digits
+; Each byte takes two hex digits, so half a byte is a mistake.
+.dat x"123"
@@ -0,0 +1,5 @@
+; error: it's all one name, so .len doesn't apply
+; flags: -ident-chars .
+; With . allowed in names, msg.len is a name of its own, not msg's length.
+:msg .dat 1, 2
+.dat msg.len
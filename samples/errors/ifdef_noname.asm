@@ -0,0 +1,5 @@
+; error: .IFDEF needs a name; found newline
+; .IFDEF only tests a name; there's nothing to test here.
+.ifdef
+  mov r0, #1
+.endif
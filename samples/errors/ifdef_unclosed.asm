@@ -0,0 +1,4 @@
+; error: .IFDEF has no .ENDIF before the end of the file
+; Every .IFDEF needs an .ENDIF in the same file.
+.ifdef DEBUG
+  .dat 1
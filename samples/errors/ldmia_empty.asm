@@ -0,0 +1,2 @@
+; error: LDMIA has an empty register list
+  ldmia r0, {}
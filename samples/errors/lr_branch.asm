@@ -0,0 +1,3 @@
+; error: to return to it, use RET
+; BX LR is the habit from other ARM-like machines; here it's RET.
+  bx lr
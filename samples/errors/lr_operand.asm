@@ -0,0 +1,3 @@
+; error: not as an operand of MOV
+; LR only appears in PUSH lists, so reading it takes a PUSH and a POP.
+  mov r0, lr
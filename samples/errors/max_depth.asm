@@ -0,0 +1,4 @@
+; error: more than 2 levels of brackets
+; flags: -max-depth 2
+; Three levels of brackets, one more than -max-depth allows.
+.dat ((1 + (2)) * 3)
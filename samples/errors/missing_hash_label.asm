@@ -0,0 +1,4 @@
+; error: MOV needs a register or #literal as operand 2, but found the label 'label'; literals need a #, eg. #label
+; Without the #, a label where a literal belongs gets a hint to add one.
+  mov r0, label
+:label
@@ -0,0 +1,3 @@
+; error: ADD needs a register or #literal as operand 2, but found the number 5; literals need a #, eg. #5
+; A bare number is the same mistake as a bare label.
+  add r0, 5
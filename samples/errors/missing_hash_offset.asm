@@ -0,0 +1,3 @@
+; error: Expected a literal, but found '4'; literals need a #, eg. #4
+; A load/store offset is a literal too, so it needs the #.
+  ldr r0, [r1, 4]
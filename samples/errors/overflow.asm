@@ -0,0 +1,3 @@
+; error: Value 65536 (0x10000) doesn't fit in 16 bits
+; The sum is done in full, so it isn't quietly 0 when it's used.
+  mov r0, #(1 << 12) * 16
@@ -0,0 +1,6 @@
+; error: Overlaps earlier code or data
+; A later .ORG can't write over what an earlier one put there.
+.org 0x10
+  .dat 1, 2, 3
+.org 0x11
+  .dat 4
@@ -0,0 +1,4 @@
+; error: '€' (U+20AC) doesn't fit in a byte, so it can't be in a packed string
+; A packed string has a byte per character, and € needs more than one.
+.strings packed
+.dat "€"
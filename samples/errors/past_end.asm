@@ -0,0 +1,4 @@
+; error: Runs past the end of memory
+; Nothing can be written after 0xffff; it would wrap around to 0.
+.org 0xfffe
+  .dat 1, 2, 3
@@ -0,0 +1,2 @@
+; error: POP has an empty register list
+  pop { }
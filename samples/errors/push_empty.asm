@@ -0,0 +1,3 @@
+; error: PUSH has an empty register list
+; A PUSH of nothing is a mistake rather than a no-op.
+  push {}
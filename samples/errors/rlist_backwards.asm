@@ -0,0 +1,3 @@
+; error: Register range r3-r0 is backwards; write it as r0-r3
+; A range runs from the lower register to the higher.
+  push {r3-r0}
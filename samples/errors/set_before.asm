@@ -0,0 +1,4 @@
+; error: used before its first .SET
+; A variable has no value until it's first assigned.
+  .dat count
+.set count, 1
@@ -0,0 +1,4 @@
+; error: Load/store offset 128 (0x80) is out of range; the limit is 127 (7 bits)
+; An SP offset only has the 7 bits below Rd.
+.define frame_size, 128
+  ldr r0, [sp, #frame_size]
@@ -0,0 +1,25 @@
+; Expressions are worked out without cutting the parts down to 16 bits, and
+; only the result has to fit.
+  .dat (1 << 12) * 16 / 32      ; 0x0800, not 0: 65536 / 32
+  .dat 0x12345 >> 4             ; 0x1234
+  .dat 0x10000 - 1              ; 0xffff
+  .dat -6 / 2                   ; -3, 0xfffd
+  mov r0, #(1 << 16) >> 8       ; 0x100, MOV and MVH
+  mov r1, #(0x300 * 0x100) >> 12 ; 0x30
+
+; The 16-bit rules still hold where they always did.
+  .dat 0x8000 >> 1              ; 0x4000; >> is logical
+  .dat -16 >> 2                 ; 0x3ffc, of 0xfff0
+  .dat 0x8000 >>> 1             ; 0xc000; >>> is arithmetic
+  .dat -1 < 0                   ; 0; comparisons are unsigned
+  .dat ~0, -~0, ~0x8000         ; 0xffff, 1, 0x7fff
+
+; Precedence, which each of these would get wrong if it went left to right.
+  .dat 1 << 2 | 3 & 1           ; 5, (1 << 2) | (3 & 1)
+  .dat 6 & 3 + 1                ; 4, 6 & (3 + 1)
+  .dat 1 ^ 3 | 1                ; 3, (1 ^ 3) | 1
+  .dat 3 ^ 1 & 2                ; 3, 3 ^ (1 & 2)
+  .dat 1 << 2 + 1               ; 8, 1 << (2 + 1)
+  .dat 2 + 3 * 4                ; 14
+  .dat 2 | 1 == 3               ; 1, (2 | 1) == 3
+  .dat 8 - 2 - 1, 16 / 4 / 2    ; 5, 2; left-associative
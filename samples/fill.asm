@@ -0,0 +1,5 @@
+; .FILL writes copies of a value; .RESERVE skips words.
+:buf .fill 0xffff, 4
+:gap .reserve 3
+:after .fill count=2, value=0x1234
+:end .dat buf, gap, after, end
@@ -0,0 +1,14 @@
+; Labels used before they're defined.
+:start
+  mov r0, #table
+  bl count
+  b done
+
+:count
+  ldr r1, [r0]
+  add r0, #1
+  ret
+
+:table .dat 1, 2, 3
+:done
+  brk
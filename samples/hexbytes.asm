@@ -0,0 +1,8 @@
+; Hex byte strings pack two bytes to a word, in .ENDIAN order.
+.dat x"1234"            ; 0x1234
+.dat x"DEADbeef", 7     ; 0xdead, 0xbeef, 0x0007
+.dat x"abcdef"          ; 0xabcd, 0xef00
+.byte x"01", 2, x"0304" ; 0x0102, 0x0304
+.endian little
+.dat x"1234"            ; 0x3412
+.byte x"0102"           ; 0x0201
@@ -0,0 +1,10 @@
+; flags: -ident-chars .$
+; With -ident-chars, names can have . and $ after the first character, but a
+; bare $ is still the current address.
+:init.start
+  mov r0, #1
+:count$
+.dat 3, 4
+:main.loop
+  b init.start
+.dat count$, $, =main.loop
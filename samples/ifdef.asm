@@ -0,0 +1,29 @@
+; .IFDEF and .IFNDEF keep or leave out lines, and nest. Left-out lines aren't
+; parsed, so they can use undefined names and even be malformed.
+.define DEBUG, 1
+:start
+.ifdef DEBUG
+  mov r0, #1           ; Kept.
+.else
+  mov r0, #2
+.endif
+.ifndef DEBUG
+  bl debug_only
+  .dat 5foo
+.else
+  mov r1, #2           ; Kept.
+  .ifdef start
+    .ifndef later      ; Defined, but further down, so not yet.
+      mov r3, #1       ; Kept.
+    .else
+      mov r3, #2
+    .endif
+  .else
+    mov r2, #2
+  .endif
+.endif
+.ifdef NOT_DEFINED
+  .dat 0xbad
+.endif
+:later
+  .dat 0xe0f
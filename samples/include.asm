@@ -0,0 +1,6 @@
+; .INCLUDE "file" reads a file relative to this one. __LINE__ counts lines in
+; whichever file it's written in, and carries on here afterwards.
+  .dat __LINE__
+.include "include/lines.asm"
+  .dat __LINE__
+  bl included
@@ -0,0 +1,5 @@
+; Included by include.asm, so this isn't a sample on its own.
+:included
+  .dat __LINE__
+  .include "nested.asm"
+  .dat __LINE__
@@ -0,0 +1 @@
+  .dat 0xbeef, __LINE__
@@ -0,0 +1,11 @@
+; =label is a label's address, here in a jump table of labels that only come
+; after it.
+:jump_table
+.dat =start, =loop, =finish, finish + 1   ; 4, 5, 7, 8
+:start
+  mov r0, #3
+:loop
+  sub r0, #1
+  bne loop
+:finish
+  ret
@@ -0,0 +1,17 @@
+; Load/store offsets are expressions like any other, so #4, #0x4, #0b100 and a
+; name for 4 all encode the same, in both the pre- and post-index forms. A
+; leading zero is still decimal: #010 is 10.
+.define off, 4
+  ldr r0, [r1, #4]
+  ldr r0, [r1, #0x4]
+  ldr r0, [r1, #0b100]
+  ldr r0, [r1, #off]
+  ldr r0, [r1, #010]
+  ldr r0, [r1], #4
+  ldr r0, [r1], #0x4
+  ldr r0, [r1], #0b100
+  ldr r0, [r1], #off
+  str r0, [r1, #0xF]
+  ldr r0, [r1, #label - 10]
+  ldr r0, [sp, #0x7f]
+:label
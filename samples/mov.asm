@@ -0,0 +1,11 @@
+; MOV immediates: 8 bits fit as they are, small negative numbers become NEG,
+; and anything else takes MOV of the low byte then MVH of the high byte.
+  mov r0, #0
+  mov r1, #255
+  mov r2, #-1
+  mov r3, #-255
+  mov r4, #256
+  mov r5, #0x1234
+  mov r6, #0xff00
+  mov r7, #label
+:label
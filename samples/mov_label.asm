@@ -0,0 +1,10 @@
+; MOV of a label's address, where the label comes later. The first pass doesn't
+; know far's address yet, so it only takes MOV+MVH once the passes settle.
+  mov r0, #far                  ; 0x0800, 0x7802
+  mov r1, #near                 ; 0x0903
+:near
+  mov r2, #far - near           ; 0x0afd, 0x7a01
+  mov r3, #near - far           ; 0x0b03, 0x7bfe
+.org 0x200
+:far
+  ret
@@ -0,0 +1,11 @@
+; .ORG moves assembly elsewhere; the gap is filled with 0.
+:start
+  b main
+
+.org 0x10
+:main
+  mov r0, #data
+  brk
+
+.org 0x20
+:data .dat 0xbeef
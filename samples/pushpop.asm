@@ -0,0 +1,13 @@
+; PUSH and POP need at least one register, but LR or PC on its own counts.
+; errors/push_empty.asm has the empty case.
+  push {lr}
+  pop {pc}
+  push {r3}
+  push {r0-r2, lr}
+  pop {r0-r2, pc}
+; A range can be mixed with single registers, and one register can be
+; listed more than once. errors/rlist_backwards.asm has r3-r0.
+  push {r0-r3, r5}
+  push {r0-r0}
+  push {r0-r3, r2}
+  ldmia r7, {r0-r2, r4-r5}
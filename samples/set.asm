@@ -0,0 +1,11 @@
+; .SET reassigns a variable as the program goes on. Here it lays out the
+; fields of a record.
+.set offset, 0
+.const NAME, offset
+.set offset, offset + 8
+.const AGE, offset
+.set offset, offset + 1
+.const SIZE, offset
+
+  ldr r0, [r1, #AGE]
+  .dat NAME, AGE, SIZE, offset
@@ -0,0 +1,7 @@
+; An SP offset has 7 bits, 0-127, and can be any expression, including a name
+; whose .define comes later.
+.define frame_size, 100
+  ldr r0, [sp, #frame_size]      ; 0xd864
+  str r1, [sp, #frame_size + 27] ; 0xdcff, the largest
+  ldr r2, [sp, #locals]          ; 0xd920
+.define locals, 32
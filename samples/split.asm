@@ -0,0 +1,11 @@
+; flags: -split
+; -split writes each segment to its own file, named for its origin, and lists
+; them in out.manifest. Here that's the two .ORG blocks of a banked program.
+.org 0x0000
+:start
+  mov r0, #bank_data
+  ldr r1, [r0]
+  b start
+
+.org 0x8000
+:bank_data .dat 0x1234, 0x5678
@@ -0,0 +1,10 @@
+; __LINE__ is the line it's written on, wherever it's used: a .dat value, an
+; instruction's immediate, a .define or part of a bigger expression. __FILE__
+; isn't covered here, since it's the path check.sh passes, which varies.
+  .dat __LINE__
+  mov r0, #__LINE__
+
+.define line, __LINE__
+  .dat line, __LINE__ * 2 + 1
+  ldr r0, [r1, #__LINE__ - 1]
+  .byte __LINE__, __LINE__
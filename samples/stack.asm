@@ -0,0 +1,8 @@
+; ADD SP and SUB SP take an 8-bit immediate, but a negative one flips the
+; operation: ADD SP, #-8 is SUB SP, #8.
+  add sp, #8
+  sub sp, #8
+  add sp, #-8
+  sub sp, #-8
+  add sp, #255
+  sub sp, #-255
@@ -0,0 +1,13 @@
+; Strings in .DAT are a word per character, by default.
+:msg .dat "Hi!", 0
+:two .dat "a", 1, "bc"
+:len .dat msg.len
+
+; Each .strings mode with multibyte characters: é is U+00E9, two bytes in
+; UTF-8, and € is U+20AC, three.
+:cps .dat "é€"                  ; 0x00e9, 0x20ac
+.strings utf8
+:utf .dat "é€"                  ; 0xc3a9, 0xe282, 0xac00
+.byte "é"                       ; 0xc3a9
+.strings packed
+:pk .dat "é!"                   ; 0xe921